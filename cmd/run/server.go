@@ -3,25 +3,51 @@ package run
 import (
 	"context"
 	"log"
+	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"paqet/internal/conf"
 	"paqet/internal/server"
 )
 
+// drainTimeout is how long in-flight streams get to finish on shutdown.
+const drainTimeout = 5 * time.Second
+
 func startServer(cfg *conf.Conf) {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	server, err := server.New(cfg)
 	if err != nil {
 		log.Fatalf("failed to initialize server: %v", err)
 	}
-	if err := server.Start(ctx); err != nil {
+	if err := server.Start(runCtx); err != nil {
 		log.Fatalf("server encountered an error: %v", err)
 	}
 
+	// SIGHUP reloads the users and acl sections, so credentials and rules
+	// can change without dropping everyone else.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			cfg, err := conf.LoadFromFile(confPath)
+			if err != nil {
+				log.Printf("failed to reload configuration: %v", err)
+				continue
+			}
+			server.SetUsers(cfg.Users)
+			server.SetACL(cfg.ACL)
+		}
+	}()
+
 	<-ctx.Done()
+	stop() // a second signal exits at once
 	log.Printf("shutdown signal received, shutting down...")
+	server.Drain(drainTimeout)
 }
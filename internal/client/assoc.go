@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"errors"
+
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// Associate opens a UDP association: a stream whose datagrams may go to
+// any address, all leaving the server from the one socket it returns the
+// address of. It returns errors.ErrUnsupported if the server does not
+// support associations.
+func (c *Client) Associate(ctx context.Context) (*protocol.AssocStrm, *tnet.Addr, error) {
+	strm, sess, err := c.newStrm(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sess.features.Has(protocol.FASSOC) {
+		strm.Close()
+		return nil, nil, errors.ErrUnsupported
+	}
+	stop := context.AfterFunc(ctx, func() { strm.Close() })
+	defer stop()
+
+	p := protocol.Proto{Type: protocol.PASOC, Ver: sess.ver}
+	if err := p.Write(strm); err != nil {
+		strm.Close()
+		return nil, nil, err
+	}
+	bound, err := readResult(strm)
+	if err != nil {
+		strm.Close()
+		return nil, nil, err
+	}
+
+	ustrm := protocol.NewUDPStrm(strm)
+	if sess.flows != nil {
+		ustrm = protocol.NewFlowStrm(strm, sess.flows)
+	}
+	flog.Debugf("UDP association %d opened, server bound %s", strm.SID(), bound)
+	return protocol.NewAssocStrm(ustrm), bound, nil
+}
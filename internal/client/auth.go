@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+const authTimeout = 10 * time.Second
+
+// authenticate proves the configured user to the server on a new conn,
+// before any other stream is opened on it, and has the server prove it holds
+// the same key.
+func (tc *timedConn) authenticate(conn tnet.Conn) error {
+	u := tc.cfg.User
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return err
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(authTimeout))
+
+	clientChallenge := make([]byte, 32)
+	rand.Read(clientChallenge)
+	p := protocol.Proto{Type: protocol.PAUTH, User: u.Name, Auth: clientChallenge}
+	if err := p.Write(strm); err != nil {
+		return err
+	}
+	if err := p.Read(strm); err != nil {
+		return fmt.Errorf("server rejected user %s: %w", u.Name, err)
+	}
+	if p.Type != protocol.PAUTH || len(p.Auth) == 0 {
+		return fmt.Errorf("server sent no challenge for user %s", u.Name)
+	}
+	challenge := p.Auth
+	p = protocol.Proto{Type: protocol.PAUTH, User: u.Name, Auth: protocol.AuthMAC(u.Secret, challenge)}
+	if err := p.Write(strm); err != nil {
+		return err
+	}
+	if err := p.Read(strm); err != nil || p.Type != protocol.PAUTH || p.User != u.Name {
+		return fmt.Errorf("server rejected credentials for user %s", u.Name)
+	}
+	if !hmac.Equal(p.Auth, protocol.ServerAuthMAC(u.Secret, challenge, clientChallenge)) {
+		return fmt.Errorf("server did not prove the key of user %s", u.Name)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"paqet/internal/conf"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/iterator"
+	"paqet/internal/tnet/transport"
 )
 
 type Client struct {
@@ -14,6 +15,7 @@ type Client struct {
 	iter    *iterator.Iterator[*timedConn]
 	udpPool *udpPool
 	mu      sync.Mutex
+	revoked bool
 }
 
 func New(cfg *conf.Conf) (*Client, error) {
@@ -26,10 +28,16 @@ func New(cfg *conf.Conf) (*Client, error) {
 }
 
 func (c *Client) Start(ctx context.Context) error {
+	dialer, err := transport.NewDialer(c.cfg)
+	if err != nil {
+		return err
+	}
+
 	for i := range c.cfg.Transport.Conn {
-		tc, err := newTimedConn(c.cfg)
+		tc, err := newTimedConn(c.cfg, dialer)
 		if err != nil {
 			flog.Errorf("failed to create connection %d: %v", i+1, err)
+			dialer.Close()
 			return err
 		}
 		c.iter.Items = append(c.iter.Items, tc)
@@ -38,19 +46,12 @@ func (c *Client) Start(ctx context.Context) error {
 		for _, tc := range c.iter.Items {
 			tc.close()
 		}
+		dialer.Close()
 	})
 
 	go c.ticker(ctx)
 	go c.udpPool.ticker(ctx)
 
-	ipv4Addr := "<nil>"
-	ipv6Addr := "<nil>"
-	if c.cfg.Network.IPv4.Addr != nil {
-		ipv4Addr = c.cfg.Network.IPv4.Addr.IP.String()
-	}
-	if c.cfg.Network.IPv6.Addr != nil {
-		ipv6Addr = c.cfg.Network.IPv6.Addr.IP.String()
-	}
-	flog.Infof("client IPv4:%s IPv6:%s -> %s (%d connections)", ipv4Addr, ipv6Addr, c.cfg.Server.Addr, len(c.iter.Items))
+	flog.Infof("client %s -> %s (%d connections)", c.cfg.Network.Describe(), c.cfg.Server.Addr, len(c.iter.Items))
 	return nil
 }
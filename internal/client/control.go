@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+const (
+	pingInterval = 5 * time.Second
+	pingTimeout  = 15 * time.Second
+)
+
+// control is the client end of a connection's control stream. It keeps the
+// server's copy of the TCP flags current, measures the round trip with
+// keepalives, and tracks what the server's notices say of the connection.
+type control struct {
+	conn tnet.Conn
+	strm tnet.Strm
+	ver  byte
+	user string
+	tcpf []conf.TCPF
+
+	wmu      sync.Mutex
+	acked    atomic.Bool
+	pinged   atomic.Int64
+	hold     atomic.Int64
+	draining atomic.Bool
+	revoked  atomic.Bool
+	done     chan struct{}
+}
+
+// openControl opens the control stream on conn and sends the TCP flags,
+// writing with protocol version ver.
+func (tc *timedConn) openControl(conn tnet.Conn, ver byte) (*control, error) {
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return nil, err
+	}
+	p := protocol.Proto{Type: protocol.PCTRL, Ver: ver}
+	if err := p.Write(strm); err != nil {
+		strm.Close()
+		return nil, err
+	}
+	c := &control{conn: conn, strm: strm, ver: ver, tcpf: tc.cfg.Network.TCP.RF, done: make(chan struct{})}
+	if tc.cfg.User != nil {
+		c.user = tc.cfg.User.Name
+	}
+	c.send(&protocol.Proto{Type: protocol.PTCPF, TCPF: c.tcpf})
+	go c.read()
+	go c.keepalive()
+	return c, nil
+}
+
+func (c *control) send(p *protocol.Proto) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	p.Ver = c.ver
+	return p.Write(c.strm)
+}
+
+func (c *control) read() {
+	defer close(c.done)
+	var p protocol.Proto
+	for {
+		if err := p.Read(c.strm); err != nil {
+			flog.Debugf("control stream to %s closed: %v", c.conn.RemoteAddr(), err)
+			return
+		}
+		switch p.Type {
+		case protocol.PPONG:
+			if sent := c.pinged.Swap(0); sent != 0 {
+				flog.Debugf("round trip to %s: %s", c.conn.RemoteAddr(), time.Duration(time.Now().UnixNano()-sent))
+			}
+		case protocol.PRSLT:
+			if !c.acked.Swap(true) {
+				flog.Debugf("server %s acknowledged TCP flags", c.conn.RemoteAddr())
+			}
+		case protocol.PNOTE:
+			c.notice(&p)
+		default:
+			flog.Debugf("unexpected message type %d on control stream to %s", p.Type, c.conn.RemoteAddr())
+		}
+	}
+}
+
+func (c *control) notice(p *protocol.Proto) {
+	switch p.Code {
+	case protocol.NGOAWAY:
+		if !c.draining.Swap(true) {
+			flog.Infof("server %s is shutting down, opening new streams elsewhere", c.conn.RemoteAddr())
+			time.AfterFunc(p.Delay, func() { c.conn.Close() })
+		}
+	case protocol.NREVOKED:
+		flog.Errorf("server %s no longer accepts user %s, not reconnecting", c.conn.RemoteAddr(), c.user)
+		c.revoked.Store(true)
+		c.conn.Close()
+	case protocol.NRATELIMIT:
+		c.hold.Store(time.Now().Add(p.Delay).UnixNano())
+		flog.Warnf("server %s is rate limiting new streams, holding them for %s", c.conn.RemoteAddr(), p.Delay)
+	default:
+		flog.Debugf("unknown notice %d from %s", p.Code, c.conn.RemoteAddr())
+	}
+}
+
+// keepalive pings the server, resending the TCP flags until they are
+// acknowledged, and closes the connection when pongs stop coming.
+func (c *control) keepalive() {
+	t := time.NewTicker(pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		now := time.Now().UnixNano()
+		if sent := c.pinged.Load(); sent != 0 && time.Duration(now-sent) > pingTimeout {
+			flog.Warnf("connection to %s timed out: no pong for %s", c.conn.RemoteAddr(), pingTimeout)
+			c.conn.Close()
+			return
+		}
+		if !c.acked.Load() {
+			c.send(&protocol.Proto{Type: protocol.PTCPF, TCPF: c.tcpf})
+		}
+		if c.pinged.CompareAndSwap(0, now) {
+			c.send(&protocol.Proto{Type: protocol.PPING})
+		}
+	}
+}
+
+// usable reports whether new streams may be opened on the connection.
+func (c *control) usable() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return !c.draining.Load() && !c.revoked.Load()
+	}
+}
+
+// wait holds a new stream back while the server is rate limiting.
+func (c *control) wait(ctx context.Context) error {
+	d := time.Until(time.Unix(0, c.hold.Load()))
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,49 +2,98 @@ package client
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"paqet/internal/flog"
 	"paqet/internal/tnet"
 )
 
-func (c *Client) newConn() (tnet.Conn, error) {
+const (
+	retryMin = 100 * time.Millisecond
+	retryMax = 5 * time.Second
+)
+
+// errRevoked is returned for every new stream once the server has revoked
+// the configured user, as reconnecting with the same credentials would only
+// be refused.
+var errRevoked = errors.New("server no longer accepts the configured user")
+
+func (c *Client) newConn() (tnet.Conn, session, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.revoked {
+		return nil, session{}, errRevoked
+	}
 	autoExpire := 300
 	tc := c.iter.Next()
-	go tc.sendTCPF(tc.conn)
-	err := tc.conn.Ping(false)
-	if err != nil {
-		flog.Infof("connection lost, retrying....")
-		if tc.conn != nil {
+	if !tc.alive() {
+		if tc.sess.ctrl != nil && tc.sess.ctrl.revoked.Load() {
+			c.revoked = true
+			return nil, session{}, errRevoked
+		}
+		// A draining connection closes itself once its streams have had
+		// time to finish.
+		if tc.sess.ctrl == nil || !tc.sess.ctrl.draining.Load() {
+			flog.Infof("connection lost, retrying....")
 			tc.conn.Close()
 		}
-		conn, err := tc.createConn()
+		conn, sess, err := tc.createConn()
 		if err != nil {
-			return nil, err
+			return nil, session{}, err
 		}
-		tc.conn = conn
+		tc.conn, tc.sess = conn, sess
 		tc.expire = time.Now().Add(time.Duration(autoExpire) * time.Second)
 	}
-	return tc.conn, nil
+	return tc.conn, tc.sess, nil
 }
 
-func (c *Client) newStrm(ctx context.Context) (tnet.Strm, error) {
+// newStrm opens a stream on the next connection, returning it with what
+// the connection supports. Failed attempts are retried with a growing
+// delay, so a server that is down or draining is not redialed in a loop.
+func (c *Client) newStrm(ctx context.Context) (tnet.Strm, session, error) {
+	var delay time.Duration
 	for {
 		if err := ctx.Err(); err != nil {
-			return nil, err
+			return nil, session{}, err
+		}
+		conn, sess, err := c.newConn()
+		if errors.Is(err, errRevoked) {
+			return nil, session{}, err
 		}
-		conn, err := c.newConn()
 		if err != nil {
-			flog.Debugf("failed to open conn, retrying: %v", err)
+			delay = min(max(2*delay, retryMin), retryMax)
+			flog.Debugf("failed to open conn, retrying in %s: %v", delay, err)
+			if err := sleep(ctx, delay); err != nil {
+				return nil, session{}, err
+			}
 			continue
 		}
+		if sess.ctrl != nil {
+			if err := sess.ctrl.wait(ctx); err != nil {
+				return nil, session{}, err
+			}
+		}
 		strm, err := conn.OpenStrm()
 		if err != nil {
-			flog.Debugf("failed to open stream, retrying: %v", err)
+			delay = min(max(2*delay, retryMin), retryMax)
+			flog.Debugf("failed to open stream, retrying in %s: %v", delay, err)
+			if err := sleep(ctx, delay); err != nil {
+				return nil, session{}, err
+			}
 			continue
 		}
-		return strm, nil
+		return strm, sess, nil
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
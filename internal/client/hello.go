@@ -0,0 +1,48 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+const helloTimeout = 10 * time.Second
+
+// hello agrees with the server on a protocol version and the features
+// used on conn. A server that predates PHELO closes the stream, and is
+// only sent the base protocol.
+func (tc *timedConn) hello(conn tnet.Conn) (byte, protocol.Features, error) {
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(helloTimeout))
+
+	local := protocol.NewHello()
+	if err := local.Write(strm); err != nil {
+		return 0, 0, err
+	}
+	var remote protocol.Proto
+	if err := remote.Read(strm); err != nil {
+		if errors.Is(err, io.EOF) {
+			flog.Infof("server %s predates protocol negotiation, using base protocol version %d", conn.RemoteAddr(), protocol.MINVERSION)
+			return protocol.MINVERSION, 0, nil
+		}
+		return 0, 0, fmt.Errorf("protocol negotiation with %s failed: %w", conn.RemoteAddr(), err)
+	}
+	if remote.Type != protocol.PHELO {
+		return 0, 0, fmt.Errorf("protocol negotiation with %s failed: unexpected message type %d", conn.RemoteAddr(), remote.Type)
+	}
+	ver, features, err := protocol.Negotiate(&local, &remote)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot talk to server %s: %w", conn.RemoteAddr(), err)
+	}
+	flog.Debugf("using protocol version %d with %s, features: %s", ver, conn.RemoteAddr(), features)
+	return ver, features, nil
+}
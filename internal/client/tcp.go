@@ -2,17 +2,22 @@ package client
 
 import (
 	"context"
+	"fmt"
 
 	"paqet/internal/flog"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
 )
 
-func (c *Client) TCP(ctx context.Context, addr string) (tnet.Strm, error) {
-	strm, err := c.newStrm(ctx)
+// TCP opens a stream to addr through the server. It returns once the
+// server has connected, with the address the server connected from, or
+// with a *protocol.DialError if it could not connect. A server without
+// FRESULT is not asked to report either, and the stream is returned at once.
+func (c *Client) TCP(ctx context.Context, addr string) (tnet.Strm, *tnet.Addr, error) {
+	strm, sess, err := c.newStrm(ctx)
 	if err != nil {
 		flog.Debugf("failed to create stream for TCP %s: %v", addr, err)
-		return nil, err
+		return nil, nil, err
 	}
 	stop := context.AfterFunc(ctx, func() { strm.Close() })
 	defer stop()
@@ -21,17 +26,42 @@ func (c *Client) TCP(ctx context.Context, addr string) (tnet.Strm, error) {
 	if err != nil {
 		flog.Debugf("invalid TCP address %s: %v", addr, err)
 		strm.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	p := protocol.Proto{Type: protocol.PTCP, Addr: tAddr}
+	p := protocol.Proto{Type: protocol.PTCP, Addr: tAddr, Reply: sess.features.Has(protocol.FRESULT), Ver: sess.ver}
 	err = p.Write(strm)
 	if err != nil {
 		flog.Debugf("failed to write TCP protocol for %s on stream %d: %v", addr, strm.SID(), err)
 		strm.Close()
-		return nil, err
+		return nil, nil, err
+	}
+
+	var bound *tnet.Addr
+	if p.Reply {
+		if bound, err = readResult(strm); err != nil {
+			flog.Debugf("TCP stream %d for %s failed: %v", strm.SID(), addr, err)
+			strm.Close()
+			return nil, nil, err
+		}
 	}
 
 	flog.Debugf("TCP stream %d created for %s", strm.SID(), addr)
-	return strm, nil
+	return strm, bound, nil
+}
+
+// readResult waits for the PRSLT answering the request on strm, returning
+// the address the server bound or a *protocol.DialError.
+func readResult(strm tnet.Strm) (*tnet.Addr, error) {
+	var p protocol.Proto
+	if err := p.Read(strm); err != nil {
+		return nil, err
+	}
+	if p.Type != protocol.PRSLT {
+		return nil, fmt.Errorf("unexpected message type %d for dial result", p.Type)
+	}
+	if p.Code != protocol.RSUCCESS {
+		return nil, &protocol.DialError{Code: p.Code}
+	}
+	return p.Addr, nil
 }
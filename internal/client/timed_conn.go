@@ -6,46 +6,89 @@ import (
 	"paqet/internal/conf"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
-	"paqet/internal/tnet/kcp"
 )
 
 type timedConn struct {
 	cfg    *conf.Conf
+	dialer tnet.Dialer
 	conn   tnet.Conn
+	sess   session
 	expire time.Time
 }
 
-func newTimedConn(cfg *conf.Conf) (*timedConn, error) {
-	var err error
-	tc := timedConn{cfg: cfg}
-	tc.conn, err = tc.createConn()
+// session is what a connection offers beyond plain streams.
+type session struct {
+	// ver is the protocol version the connection's messages are written
+	// with.
+	ver      byte
+	features protocol.Features
+	// flows is nil unless datagrams were negotiated, and ctrl unless a
+	// control stream was.
+	flows *protocol.Flows
+	ctrl  *control
+}
+
+func newTimedConn(cfg *conf.Conf, dialer tnet.Dialer) (*timedConn, error) {
+	tc := timedConn{cfg: cfg, dialer: dialer}
+	conn, sess, err := tc.createConn()
 	if err != nil {
 		return nil, err
 	}
+	tc.conn, tc.sess = conn, sess
 
 	return &tc, nil
 }
 
-func (tc *timedConn) createConn() (tnet.Conn, error) {
-	conn, err := kcp.Dial(tc.cfg.Server.Addr, tc.cfg.Transport.KCP, tc.cfg.Network)
+func (tc *timedConn) createConn() (tnet.Conn, session, error) {
+	conn, err := tc.dialer.Dial()
 	if err != nil {
-		return nil, err
+		return nil, session{}, err
+	}
+	if tc.cfg.User != nil {
+		if err := tc.authenticate(conn); err != nil {
+			conn.Close()
+			return nil, session{}, err
+		}
 	}
-	err = tc.sendTCPF(conn)
+	ver, features, err := tc.hello(conn)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, session{}, err
+	}
+
+	sess := session{ver: ver, features: features}
+	if features.Has(protocol.FCONTROL) {
+		sess.ctrl, err = tc.openControl(conn, ver)
+	} else {
+		err = tc.sendTCPF(conn, ver)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, session{}, err
+	}
+	if dc, ok := conn.(tnet.DatagramConn); ok && features.Has(protocol.FDATAGRAM) {
+		sess.flows = protocol.NewFlows(dc)
+	}
+	return conn, sess, nil
+}
+
+// alive reports whether new streams can go on the current connection. A
+// server without control streams is probed by opening one.
+func (tc *timedConn) alive() bool {
+	if tc.sess.ctrl != nil {
+		return tc.sess.ctrl.usable()
 	}
-	return conn, nil
+	return tc.conn.Ping(false) == nil
 }
 
-func (tc *timedConn) sendTCPF(conn tnet.Conn) error {
+func (tc *timedConn) sendTCPF(conn tnet.Conn, ver byte) error {
 	strm, err := conn.OpenStrm()
 	if err != nil {
 		return err
 	}
 	defer strm.Close()
 
-	p := protocol.Proto{Type: protocol.PTCPF, TCPF: tc.cfg.Network.TCP.RF}
+	p := protocol.Proto{Type: protocol.PTCPF, TCPF: tc.cfg.Network.TCP.RF, Ver: ver}
 	err = p.Write(strm)
 	if err != nil {
 		return err
@@ -20,29 +20,17 @@ func (c *Client) UDP(ctx context.Context, lAddr, tAddr string) (tnet.Strm, bool,
 	}
 	c.udpPool.mu.RUnlock()
 
-	strm, err := c.newStrm(ctx)
-	if err != nil {
-		flog.Debugf("failed to create stream for UDP %s -> %s: %v", lAddr, tAddr, err)
-		return nil, false, 0, err
-	}
-
 	taddr, err := tnet.NewAddr(tAddr)
 	if err != nil {
 		flog.Debugf("invalid UDP address %s: %v", tAddr, err)
-		strm.Close()
 		return nil, false, 0, err
 	}
 
-	stop := context.AfterFunc(ctx, func() { strm.Close() })
-	p := protocol.Proto{Type: protocol.PUDP, Addr: taddr}
-	err = p.Write(strm)
+	strm, err := c.openUDP(ctx, taddr)
 	if err != nil {
-		stop()
-		flog.Debugf("failed to write UDP protocol for %s -> %s on stream %d: %v", lAddr, tAddr, strm.SID(), err)
-		strm.Close()
+		flog.Debugf("failed to create stream for UDP %s -> %s: %v", lAddr, tAddr, err)
 		return nil, false, 0, err
 	}
-	stop()
 
 	c.udpPool.mu.Lock()
 	if u, ok := c.udpPool.strms[key]; ok {
@@ -59,6 +47,41 @@ func (c *Client) UDP(ctx context.Context, lAddr, tAddr string) (tnet.Strm, bool,
 	return strm, true, key, nil
 }
 
+// openUDP opens a stream carrying datagrams to addr. When the connection
+// carries datagrams they travel unreliably beside the stream, which is left
+// for those too large to send that way.
+func (c *Client) openUDP(ctx context.Context, addr *tnet.Addr) (*protocol.UDPStrm, error) {
+	strm, sess, err := c.newStrm(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { strm.Close() })
+	defer stop()
+
+	if sess.flows == nil {
+		p := protocol.Proto{Type: protocol.PUDP, Addr: addr, Ver: sess.ver}
+		if err := p.Write(strm); err != nil {
+			strm.Close()
+			return nil, err
+		}
+		if sess.features.Has(protocol.FFRAMING) {
+			return protocol.NewUDPStrm(strm), nil
+		}
+		return protocol.NewRawUDPStrm(strm), nil
+	}
+
+	p := protocol.Proto{Type: protocol.PDGRM, Addr: addr, Ver: sess.ver}
+	if err := p.Write(strm); err != nil {
+		strm.Close()
+		return nil, err
+	}
+	if _, err := readResult(strm); err != nil {
+		strm.Close()
+		return nil, err
+	}
+	return protocol.NewFlowStrm(strm, sess.flows), nil
+}
+
 func (c *Client) CloseUDP(key uint64, strm tnet.Strm) error {
 	return c.udpPool.delete(key, strm)
 }
@@ -0,0 +1,111 @@
+package conf
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Rule is one entry of an egress ACL. A rule matches a destination when
+// every field it sets matches; a rule that sets none matches everything.
+type Rule struct {
+	Action string   `yaml:"action"`
+	Net_   []string `yaml:"net"`
+	Domain []string `yaml:"domain"`
+	Port_  []string `yaml:"port"`
+	Proto  string   `yaml:"proto"`
+
+	Net   []netip.Prefix `yaml:"-"`
+	Ports [][2]int       `yaml:"-"`
+}
+
+func (r *Rule) setDefaults() {}
+func (r *Rule) validate() []error {
+	var errors []error
+
+	validActions := []string{"allow", "deny"}
+	if !slices.Contains(validActions, r.Action) {
+		errors = append(errors, fmt.Errorf("action must be one of: %v", validActions))
+	}
+	validProtos := []string{"", "tcp", "udp"}
+	if !slices.Contains(validProtos, r.Proto) {
+		errors = append(errors, fmt.Errorf("proto must be tcp or udp, or unset for both"))
+	}
+
+	r.Net = nil
+	for _, n := range r.Net_ {
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			a, aerr := netip.ParseAddr(n)
+			if aerr != nil {
+				errors = append(errors, fmt.Errorf("invalid net '%s': must be a CIDR or IP address", n))
+				continue
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		r.Net = append(r.Net, p.Masked())
+	}
+
+	for i, d := range r.Domain {
+		r.Domain[i] = strings.Trim(strings.ToLower(d), ".")
+		if r.Domain[i] == "" {
+			errors = append(errors, fmt.Errorf("domain must not be empty"))
+		}
+	}
+
+	r.Ports = nil
+	for _, p := range r.Port_ {
+		lo, hi, ok := strings.Cut(p, "-")
+		if !ok {
+			hi = lo
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || l < 1 || h > 65535 || l > h {
+			errors = append(errors, fmt.Errorf("invalid port '%s': must be a port or range between 1-65535", p))
+			continue
+		}
+		r.Ports = append(r.Ports, [2]int{l, h})
+	}
+
+	return errors
+}
+
+// Match reports whether the rule covers a connection over proto to ip and
+// port. host is the name the client asked for, or "" if it sent an address.
+func (r *Rule) Match(proto, host string, ip netip.Addr, port int) bool {
+	if r.Proto != "" && r.Proto != proto {
+		return false
+	}
+	if len(r.Net) > 0 && !slices.ContainsFunc(r.Net, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+		return false
+	}
+	if len(r.Domain) > 0 && !slices.ContainsFunc(r.Domain, func(d string) bool {
+		return host == d || strings.HasSuffix(host, "."+d)
+	}) {
+		return false
+	}
+	if len(r.Ports) > 0 && !slices.ContainsFunc(r.Ports, func(p [2]int) bool { return port >= p[0] && port <= p[1] }) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) String() string {
+	parts := []string{r.Action}
+	if r.Proto != "" {
+		parts = append(parts, "proto "+r.Proto)
+	}
+	if len(r.Net_) > 0 {
+		parts = append(parts, "net "+strings.Join(r.Net_, ","))
+	}
+	if len(r.Domain) > 0 {
+		parts = append(parts, "domain "+strings.Join(r.Domain, ","))
+	}
+	if len(r.Port_) > 0 {
+		parts = append(parts, "port "+strings.Join(r.Port_, ","))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,150 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const auto = "auto"
+
+var (
+	probeIPv4 = net.ParseIP("8.8.8.8")
+	probeIPv6 = net.ParseIP("2001:4860:4860::8888")
+)
+
+// resolveAuto fills in `interface: auto` and `addr: auto` from the routing
+// table. The client looks up the route to the server; the server uses its
+// listen address, or the default route when listening on all addresses.
+func (n *Network) resolveAuto(role string, target *net.UDPAddr) []error {
+	var errors []error
+
+	port := 0
+	if role == "server" && target != nil {
+		port = target.Port
+	}
+	for _, a := range []*Addr{&n.IPv4, &n.IPv6} {
+		if a.Addr_ != auto {
+			continue
+		}
+		ipv6 := a == &n.IPv6
+		ip, err := sourceIP(target, ipv6)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("failed to detect %s address: %v", family(ipv6), err))
+			a.Addr_ = ""
+			continue
+		}
+		a.Addr_ = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		a.AddrAuto = true
+	}
+
+	if n.Interface_ == auto {
+		iface, err := n.detectInterface(target)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("failed to detect network interface: %v", err))
+			n.Interface_ = ""
+		} else {
+			n.Interface_ = iface.Name
+			n.AutoInterface = true
+		}
+	}
+
+	return errors
+}
+
+// detectInterface returns the interface owning the local address used to
+// reach target, preferring an address that is already configured.
+func (n *Network) detectInterface(target *net.UDPAddr) (*net.Interface, error) {
+	ipv6 := target != nil && target.IP != nil && target.IP.To4() == nil
+	local := n.IPv4.Addr_
+	if ipv6 || local == "" {
+		local = n.IPv6.Addr_
+	}
+	if host, _, err := net.SplitHostPort(local); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			return interfaceByIP(ip)
+		}
+	}
+
+	ip, err := sourceIP(target, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	return interfaceByIP(ip)
+}
+
+// sourceIP returns the local address of the requested family that the kernel
+// would use to reach target.
+func sourceIP(target *net.UDPAddr, ipv6 bool) (net.IP, error) {
+	if target != nil && target.IP != nil && (target.IP.To4() == nil) == ipv6 {
+		if !target.IP.IsUnspecified() && !target.IP.IsLoopback() {
+			if _, err := interfaceByIP(target.IP); err == nil {
+				return target.IP, nil
+			}
+			return routeSource(target.IP)
+		}
+	}
+	if ipv6 {
+		return routeSource(probeIPv6)
+	}
+	return routeSource(probeIPv4)
+}
+
+// routeSource connects a UDP socket to dst, which selects a route without
+// sending anything, and reports the chosen source address.
+func routeSource(dst net.IP) (net.IP, error) {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s: %v", dst, err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func interfaceByIP(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface has address %s", ip)
+}
+
+// Describe summarizes the interface and addresses in use, marking the ones
+// that were detected automatically.
+func (n *Network) Describe() string {
+	if n.Bind != nil {
+		return n.Socket + " " + n.Bind.String()
+	}
+	s := n.Interface_
+	if n.AutoInterface {
+		s += "(auto)"
+	}
+	for _, a := range []*Addr{&n.IPv4, &n.IPv6} {
+		if a.Addr == nil {
+			continue
+		}
+		s += " " + a.Addr.String()
+		if a.AddrAuto {
+			s += "(auto)"
+		}
+	}
+	return s
+}
+
+func family(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
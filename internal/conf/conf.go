@@ -19,6 +19,9 @@ type Conf struct {
 	Network   Network   `yaml:"network"`
 	Server    Server    `yaml:"server"`
 	Transport Transport `yaml:"transport"`
+	User      *User     `yaml:"user"`
+	Users     []User    `yaml:"users"`
+	ACL       []Rule    `yaml:"acl"`
 }
 
 func LoadFromFile(path string) (*Conf, error) {
@@ -58,6 +61,15 @@ func (c *Conf) setDefaults() {
 	c.Network.setDefaults(c.Role)
 	c.Server.setDefaults()
 	c.Transport.setDefaults(c.Role)
+	if c.User != nil {
+		c.User.setDefaults()
+	}
+	for i := range c.Users {
+		c.Users[i].setDefaults()
+	}
+	for i := range c.ACL {
+		c.ACL[i].setDefaults()
+	}
 }
 
 func (c *Conf) validate() error {
@@ -81,12 +93,40 @@ func (c *Conf) validate() error {
 		}
 	}
 
-	allErrors = append(allErrors, c.Network.validate()...)
-	allErrors = append(allErrors, c.Transport.validate()...)
+	allErrors = append(allErrors, c.validateUsers()...)
+	if c.Role == "client" && len(c.ACL) > 0 {
+		allErrors = append(allErrors, fmt.Errorf("acl is only valid on the server"))
+	}
+	for i := range c.ACL {
+		for _, err := range c.ACL[i].validate() {
+			allErrors = append(allErrors, fmt.Errorf("acl[%d] %v", i, err))
+		}
+	}
+
+	// The peer address is parsed first so that auto network settings can be
+	// resolved against it.
+	target := &c.Server
 	if c.Role == "server" {
-		allErrors = append(allErrors, c.Listen.validate()...)
-	} else {
-		allErrors = append(allErrors, c.Server.validate()...)
+		target = &c.Listen
+	}
+	allErrors = append(allErrors, target.validate()...)
+	allErrors = append(allErrors, c.Network.resolveAuto(c.Role, target.Addr)...)
+	allErrors = append(allErrors, c.Transport.validate()...)
+	// Per-user keys on kcp come from the pfs handshake; without it every
+	// user's traffic would be encrypted with the shared transport key.
+	if k := c.Transport.KCP; c.Transport.Protocol == "kcp" && k != nil && !k.PFS && (c.User != nil || len(c.Users) > 0) {
+		allErrors = append(allErrors, fmt.Errorf("KCP pfs must be enabled to use per-user keys"))
+	}
+	switch {
+	case c.Transport.Protocol == "stream":
+		allErrors = append(allErrors, c.Network.validateSocket(c.Role, "tcp", target.Addr)...)
+		return writeErr(allErrors)
+	case c.Transport.Carrier == "udp":
+		allErrors = append(allErrors, c.Network.validateSocket(c.Role, "udp", target.Addr)...)
+		return writeErr(allErrors)
+	}
+	allErrors = append(allErrors, c.Network.validate()...)
+	if c.Role == "client" {
 		if c.Server.Addr != nil {
 			family, local := "IPv6", c.Network.IPv6.Addr
 			if c.Server.Addr.IP.To4() != nil {
@@ -96,13 +136,37 @@ func (c *Conf) validate() error {
 				allErrors = append(allErrors, fmt.Errorf("server address is %s, but the %s interface is not configured", family, family))
 			}
 		}
-		if c.Transport.Conn > 1 && c.Network.Port != 0 {
-			allErrors = append(allErrors, fmt.Errorf("only one connection is allowed when a client port is explicitly set"))
-		}
 	}
 	return writeErr(allErrors)
 }
 
+func (c *Conf) validateUsers() []error {
+	var errors []error
+
+	if c.Role == "server" && c.User != nil {
+		errors = append(errors, fmt.Errorf("user is only valid on the client; list server credentials under users"))
+	}
+	if c.Role == "client" && len(c.Users) > 0 {
+		errors = append(errors, fmt.Errorf("users is only valid on the server"))
+	}
+	if c.User != nil {
+		for _, err := range c.User.validate() {
+			errors = append(errors, fmt.Errorf("user %v", err))
+		}
+	}
+	seen := make(map[string]bool)
+	for i := range c.Users {
+		for _, err := range c.Users[i].validate() {
+			errors = append(errors, fmt.Errorf("users[%d] %v", i, err))
+		}
+		if seen[c.Users[i].Name] {
+			errors = append(errors, fmt.Errorf("users[%d] duplicate name '%s'", i, c.Users[i].Name))
+		}
+		seen[c.Users[i].Name] = true
+	}
+	return errors
+}
+
 func writeErr(allErrors []error) error {
 	if len(allErrors) > 0 {
 		var messages []string
@@ -1,11 +1,13 @@
 package conf
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"slices"
 	"time"
 
 	"github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 type KCP struct {
@@ -25,6 +27,7 @@ type KCP struct {
 
 	Block_ string `yaml:"block"`
 	Key    string `yaml:"key"`
+	PFS    bool   `yaml:"pfs"`
 
 	Smuxbuf   int `yaml:"smuxbuf"`
 	Streambuf int `yaml:"streambuf"`
@@ -35,6 +38,8 @@ type KCP struct {
 	Smuxkalive   time.Duration  `yaml:"-"`
 	Smuxktimeout time.Duration  `yaml:"-"`
 	Block        kcp.BlockCrypt `yaml:"-"`
+	Sequenced    bool           `yaml:"-"`
+	PFSKey       []byte         `yaml:"-"`
 }
 
 func (k *KCP) setDefaults(role string) {
@@ -105,7 +110,7 @@ func (k *KCP) validate() []error {
 		errors = append(errors, fmt.Errorf("KCP sndwnd must be between 1-32768"))
 	}
 
-	validBlocks := []string{"aes", "aes-128", "aes-128-gcm", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none", "null"}
+	validBlocks := []string{"aes", "aes-128", "aes-128-gcm", "aes-192", "aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none", "null"}
 	if !slices.Contains(validBlocks, k.Block_) {
 		errors = append(errors, fmt.Errorf("KCP encryption block must be one of: %v", validBlocks))
 	}
@@ -117,6 +122,14 @@ func (k *KCP) validate() []error {
 		errors = append(errors, err)
 	}
 	k.Block = b
+	k.Sequenced = slices.Contains(sequencedBlocks, k.Block_)
+
+	if k.PFS {
+		if len(k.Key) == 0 {
+			errors = append(errors, fmt.Errorf("KCP pfs requires a key"))
+		}
+		k.PFSKey = pbkdf2.Key([]byte(k.Key), []byte("paqet-pfs"), 100_000, 32, sha256.New)
+	}
 
 	if k.Smuxbuf < 1024 {
 		errors = append(errors, fmt.Errorf("KCP smuxbuf must be >= 1024 bytes"))
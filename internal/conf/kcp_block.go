@@ -1,10 +1,12 @@
 package conf
 
 import (
+	"crypto/cipher"
 	"crypto/sha256"
 	"fmt"
 
 	"github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -13,22 +15,37 @@ type blockCrypt struct {
 	build   func(key []byte) (kcp.BlockCrypt, error)
 }
 
+// sequencedBlocks are the AEADs sent with counter nonces, which lets the
+// receiver drop replayed packets. The older blocks keep random nonces for
+// compatibility.
+var sequencedBlocks = []string{"aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305"}
+
 var blockCrypts = map[string]blockCrypt{
-	"aes":         {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
-	"aes-128":     {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
-	"aes-128-gcm": {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESGCMCrypt(key) }},
-	"aes-192":     {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
-	"salsa20":     {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSalsa20BlockCrypt(key) }},
-	"blowfish":    {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewBlowfishBlockCrypt(key) }},
-	"twofish":     {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTwofishBlockCrypt(key) }},
-	"cast5":       {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewCast5BlockCrypt(key) }},
-	"3des":        {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTripleDESBlockCrypt(key) }},
-	"tea":         {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTEABlockCrypt(key) }},
-	"xtea":        {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewXTEABlockCrypt(key) }},
-	"xor":         {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSimpleXORBlockCrypt(key) }},
-	"sm4":         {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSM4BlockCrypt(key) }},
-	"none":        {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewNoneBlockCrypt(key) }},
-	"null":        {0, func(key []byte) (kcp.BlockCrypt, error) { return nil, nil }},
+	"aes":                {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
+	"aes-128":            {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
+	"aes-128-gcm":        {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESGCMCrypt(key) }},
+	"aes-192":            {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
+	"aes-256-gcm":        {32, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESGCMCrypt(key) }},
+	"chacha20-poly1305":  {32, func(key []byte) (kcp.BlockCrypt, error) { return newAEAD(chacha20poly1305.New(key)) }},
+	"xchacha20-poly1305": {32, func(key []byte) (kcp.BlockCrypt, error) { return newAEAD(chacha20poly1305.NewX(key)) }},
+	"salsa20":            {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSalsa20BlockCrypt(key) }},
+	"blowfish":           {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewBlowfishBlockCrypt(key) }},
+	"twofish":            {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTwofishBlockCrypt(key) }},
+	"cast5":              {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewCast5BlockCrypt(key) }},
+	"3des":               {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTripleDESBlockCrypt(key) }},
+	"tea":                {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTEABlockCrypt(key) }},
+	"xtea":               {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewXTEABlockCrypt(key) }},
+	"xor":                {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSimpleXORBlockCrypt(key) }},
+	"sm4":                {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSM4BlockCrypt(key) }},
+	"none":               {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewNoneBlockCrypt(key) }},
+	"null":               {0, func(key []byte) (kcp.BlockCrypt, error) { return nil, nil }},
+}
+
+func newAEAD(aead cipher.AEAD, err error) (kcp.BlockCrypt, error) {
+	if err != nil {
+		return nil, err
+	}
+	return kcp.NewAEADCrypt(aead), nil
 }
 
 func newBlock(block, key string) (kcp.BlockCrypt, error) {
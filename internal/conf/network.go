@@ -11,6 +11,8 @@ type Addr struct {
 	RouterMac_ string           `yaml:"router_mac"`
 	Addr       *net.UDPAddr     `yaml:"-"`
 	Router     net.HardwareAddr `yaml:"-"`
+	RouterAuto bool             `yaml:"-"`
+	AddrAuto   bool             `yaml:"-"`
 }
 
 type Network struct {
@@ -20,8 +22,13 @@ type Network struct {
 	IPv6       Addr           `yaml:"ipv6"`
 	PCAP       PCAP           `yaml:"pcap"`
 	TCP        TCP            `yaml:"tcp"`
+	VLAN       VLAN           `yaml:"vlan"`
 	Interface  *net.Interface `yaml:"-"`
 	Port       int            `yaml:"-"`
+	Bind       *net.UDPAddr   `yaml:"-"`
+	Socket     string         `yaml:"-"`
+
+	AutoInterface bool `yaml:"-"`
 }
 
 func (n *Network) setDefaults(role string) {
@@ -38,11 +45,19 @@ func (n *Network) validate() []error {
 	if len(n.Interface_) > 15 {
 		errors = append(errors, fmt.Errorf("network interface name too long (max 15 characters): '%s'", n.Interface_))
 	}
-	lIface, err := net.InterfaceByName(n.Interface_)
-	if err != nil {
-		errors = append(errors, fmt.Errorf("failed to find network interface %s: %v", n.Interface_, err))
+	if n.Interface_ == "any" {
+		// The Linux pseudo-device capturing on every interface.
+		if runtime.GOOS != "linux" || n.PCAP.Backend != "pcap" {
+			errors = append(errors, fmt.Errorf("interface 'any' is only supported on Linux with the pcap backend"))
+		}
+		n.Interface = &net.Interface{Name: "any"}
+	} else {
+		lIface, err := net.InterfaceByName(n.Interface_)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("failed to find network interface %s: %v", n.Interface_, err))
+		}
+		n.Interface = lIface
 	}
-	n.Interface = lIface
 
 	if runtime.GOOS == "windows" && n.GUID == "" {
 		errors = append(errors, fmt.Errorf("guid is required on windows"))
@@ -52,11 +67,12 @@ func (n *Network) validate() []error {
 		errors = append(errors, fmt.Errorf("at least one address family (IPv4 or IPv6) must be configured"))
 		return errors
 	}
+	l2 := n.HasL2()
 	if n.IPv4.Addr_ != "" {
-		errors = append(errors, n.IPv4.validate()...)
+		errors = append(errors, n.IPv4.validate(l2)...)
 	}
 	if n.IPv6.Addr_ != "" {
-		errors = append(errors, n.IPv6.validate()...)
+		errors = append(errors, n.IPv6.validate(l2)...)
 	}
 
 	ipv4OK := n.IPv4.Addr != nil
@@ -74,11 +90,56 @@ func (n *Network) validate() []error {
 
 	errors = append(errors, n.PCAP.validate()...)
 	errors = append(errors, n.TCP.validate()...)
+	errors = append(errors, n.VLAN.validate()...)
 
 	return errors
 }
 
-func (n *Addr) validate() []error {
+// validateSocket checks the network section for transports over ordinary
+// kernel sockets, the udp carrier and the stream protocol, which only use a
+// local address to bind: the listen address on the server, and the
+// configured address of the server's family, if any, on the client.
+func (n *Network) validateSocket(role, socket string, target *net.UDPAddr) []error {
+	var errors []error
+
+	for _, a := range []*Addr{&n.IPv4, &n.IPv6} {
+		if a.Addr_ == "" {
+			continue
+		}
+		l, err := validateAddr(a.Addr_, false)
+		if err != nil {
+			errors = append(errors, err)
+		}
+		a.Addr = l
+	}
+
+	n.Socket = socket
+	n.Bind = &net.UDPAddr{}
+	switch {
+	case role == "server" && target != nil:
+		n.Bind = target
+	case target != nil && target.IP.To4() != nil && n.IPv4.Addr != nil:
+		n.Bind = n.IPv4.Addr
+	case target != nil && target.IP.To4() == nil && n.IPv6.Addr != nil:
+		n.Bind = n.IPv6.Addr
+	}
+	n.Port = n.Bind.Port
+
+	errors = append(errors, n.PCAP.validate()...)
+
+	return errors
+}
+
+// HasL2 reports whether frames on the interface are addressed by MAC and
+// therefore need a router MAC. Loopback accepts any destination MAC.
+func (n *Network) HasL2() bool {
+	if n.Interface == nil {
+		return true
+	}
+	return len(n.Interface.HardwareAddr) > 0 && n.Interface.Flags&net.FlagLoopback == 0
+}
+
+func (n *Addr) validate(l2 bool) []error {
 	var errors []error
 
 	l, err := validateAddr(n.Addr_, false)
@@ -88,9 +149,20 @@ func (n *Addr) validate() []error {
 	n.Addr = l
 
 	if n.RouterMac_ == "" {
+		if !l2 {
+			return errors
+		}
 		errors = append(errors, fmt.Errorf("router MAC address is required"))
 	}
 
+	if n.RouterMac_ == "auto" {
+		if runtime.GOOS != "linux" {
+			errors = append(errors, fmt.Errorf("router_mac 'auto' is only supported on Linux"))
+		}
+		n.RouterAuto = true
+		return errors
+	}
+
 	hwAddr, err := net.ParseMAC(n.RouterMac_)
 	if err != nil {
 		errors = append(errors, fmt.Errorf("invalid Router MAC address '%s': %v", n.RouterMac_, err))
@@ -3,13 +3,21 @@ package conf
 import (
 	"fmt"
 	"paqet/internal/flog"
+	"runtime"
+	"slices"
 )
 
 type PCAP struct {
-	Sockbuf int `yaml:"sockbuf"`
+	Backend string `yaml:"backend"`
+	Sockbuf int    `yaml:"sockbuf"`
+	Workers int    `yaml:"workers"`
+	Fanout  int    `yaml:"fanout"`
 }
 
 func (p *PCAP) setDefaults(role string) {
+	if p.Backend == "" {
+		p.Backend = "pcap"
+	}
 	if p.Sockbuf == 0 {
 		if role == "server" {
 			p.Sockbuf = 8 * 1024 * 1024
@@ -17,11 +25,30 @@ func (p *PCAP) setDefaults(role string) {
 			p.Sockbuf = 4 * 1024 * 1024
 		}
 	}
+	if p.Workers == 0 {
+		if role == "server" {
+			p.Workers = min(runtime.NumCPU(), 4)
+		} else {
+			p.Workers = 1
+		}
+	}
+	if p.Fanout == 0 {
+		p.Fanout = 1
+	}
 }
 
 func (p *PCAP) validate() []error {
 	var errors []error
 
+	// memnet is only registered by programs that link it, such as tests.
+	validBackends := []string{"pcap", "afpacket", "memnet"}
+	if !slices.Contains(validBackends, p.Backend) {
+		errors = append(errors, fmt.Errorf("PCAP backend must be one of: %v", validBackends))
+	}
+	if p.Backend == "afpacket" && runtime.GOOS != "linux" {
+		errors = append(errors, fmt.Errorf("PCAP backend 'afpacket' is only supported on Linux"))
+	}
+
 	if p.Sockbuf < 1024 {
 		errors = append(errors, fmt.Errorf("PCAP sockbuf must be >= 1024 bytes"))
 	}
@@ -30,6 +57,16 @@ func (p *PCAP) validate() []error {
 		errors = append(errors, fmt.Errorf("PCAP sockbuf too large (max 100MB)"))
 	}
 
+	if p.Workers < 1 || p.Workers > 64 {
+		errors = append(errors, fmt.Errorf("PCAP workers must be between 1-64"))
+	}
+	if p.Fanout < 1 || p.Fanout > 16 {
+		errors = append(errors, fmt.Errorf("PCAP fanout must be between 1-16"))
+	}
+	if p.Fanout > 1 && p.Backend != "afpacket" {
+		errors = append(errors, fmt.Errorf("PCAP fanout requires the 'afpacket' backend"))
+	}
+
 	// Should be power of 2 for optimal performance, but not required
 	if p.Sockbuf&(p.Sockbuf-1) != 0 {
 		flog.Warnf("PCAP sockbuf (%d bytes) is not a power of 2 - consider using values like 4MB, 8MB, or 16MB for better performance", p.Sockbuf)
@@ -0,0 +1,176 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Fingerprint describes the IP and TCP header values of crafted packets.
+// TTL, TOS and Window are picked per packet from their ranges.
+type Fingerprint struct {
+	TTL        Range    `yaml:"ttl"`
+	TOS        Range    `yaml:"tos"`
+	IPID       string   `yaml:"ipid"`
+	SynWindow  int      `yaml:"syn_window"`
+	Window     Range    `yaml:"window"`
+	WScale     *int     `yaml:"wscale"`
+	MSS        int      `yaml:"mss"`
+	SynOptions []string `yaml:"syn_options"`
+	Options    []string `yaml:"options"`
+}
+
+// Range is an inclusive span of values, written as a single number or as
+// [min, max]. Unlike a plain int, an explicit 0 is told apart from unset.
+type Range struct {
+	Min, Max int
+	set      bool
+}
+
+func fixed(v int) Range {
+	return Range{Min: v, Max: v, set: true}
+}
+
+func span(min, max int) Range {
+	return Range{Min: min, Max: max, set: true}
+}
+
+func (r *Range) UnmarshalYAML(unmarshal func(any) error) error {
+	var v int
+	if err := unmarshal(&v); err == nil {
+		*r = fixed(v)
+		return nil
+	}
+	var l []int
+	if err := unmarshal(&l); err != nil {
+		return err
+	}
+	switch len(l) {
+	case 1:
+		*r = fixed(l[0])
+	case 2:
+		*r = span(l[0], l[1])
+	default:
+		return fmt.Errorf("range must be a number or [min, max], got %d values", len(l))
+	}
+	return nil
+}
+
+func (r Range) valid(min, max int) bool {
+	return r.Min >= min && r.Max <= max && r.Min <= r.Max
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+var profiles = map[string]Fingerprint{
+	"linux": {
+		TTL:        fixed(64),
+		TOS:        fixed(0),
+		IPID:       "flow",
+		SynWindow:  64240,
+		Window:     span(501, 4096),
+		WScale:     intPtr(7),
+		MSS:        1460,
+		SynOptions: []string{"mss", "sack_perm", "ts", "nop", "ws"},
+		Options:    []string{"nop", "nop", "ts"},
+	},
+	"windows": {
+		TTL:        fixed(128),
+		TOS:        fixed(0),
+		IPID:       "global",
+		SynWindow:  64240,
+		Window:     span(1024, 4096),
+		WScale:     intPtr(8),
+		MSS:        1460,
+		SynOptions: []string{"mss", "nop", "ws", "nop", "nop", "sack_perm"},
+		Options:    []string{},
+	},
+	"macos": {
+		TTL:        fixed(64),
+		TOS:        fixed(0),
+		IPID:       "random",
+		SynWindow:  65535,
+		Window:     span(2048, 4096),
+		WScale:     intPtr(6),
+		MSS:        1460,
+		SynOptions: []string{"mss", "nop", "ws", "nop", "nop", "ts", "sack_perm", "eol"},
+		Options:    []string{"nop", "nop", "ts"},
+	},
+}
+
+// tcpOptions maps the option names usable in a layout to their encoded size.
+var tcpOptions = map[string]int{"mss": 4, "sack_perm": 2, "ts": 10, "nop": 1, "ws": 3, "eol": 1}
+
+// setDefaults fills the fields left unset in a custom profile from base.
+func (f *Fingerprint) setDefaults(base Fingerprint) {
+	if !f.TTL.set {
+		f.TTL = base.TTL
+	}
+	if !f.TOS.set {
+		f.TOS = base.TOS
+	}
+	if f.IPID == "" {
+		f.IPID = base.IPID
+	}
+	if f.SynWindow == 0 {
+		f.SynWindow = base.SynWindow
+	}
+	if !f.Window.set {
+		f.Window = base.Window
+	}
+	if f.WScale == nil {
+		f.WScale = base.WScale
+	}
+	if f.MSS == 0 {
+		f.MSS = base.MSS
+	}
+	if f.SynOptions == nil {
+		f.SynOptions = base.SynOptions
+	}
+	if f.Options == nil {
+		f.Options = base.Options
+	}
+}
+
+func (f *Fingerprint) validate() []error {
+	var errors []error
+
+	if !f.TTL.valid(1, 255) {
+		errors = append(errors, fmt.Errorf("profile ttl must be a value or [min, max] range within 1-255"))
+	}
+	if !f.TOS.valid(0, 255) {
+		errors = append(errors, fmt.Errorf("profile tos must be a value or [min, max] range within 0-255"))
+	}
+	validIPID := []string{"zero", "global", "flow", "random"}
+	if !slices.Contains(validIPID, f.IPID) {
+		errors = append(errors, fmt.Errorf("profile ipid must be one of: %v", validIPID))
+	}
+	if f.SynWindow < 1 || f.SynWindow > 65535 {
+		errors = append(errors, fmt.Errorf("profile syn_window must be between 1-65535"))
+	}
+	if !f.Window.valid(1, 65535) {
+		errors = append(errors, fmt.Errorf("profile window must be a value or [min, max] range within 1-65535"))
+	}
+	if *f.WScale < 0 || *f.WScale > 14 {
+		errors = append(errors, fmt.Errorf("profile wscale must be between 0-14"))
+	}
+	if f.MSS < 536 || f.MSS > 65535 {
+		errors = append(errors, fmt.Errorf("profile mss must be between 536-65535"))
+	}
+	for _, layout := range [][]string{f.SynOptions, f.Options} {
+		size := 0
+		for _, o := range layout {
+			n, ok := tcpOptions[o]
+			if !ok {
+				errors = append(errors, fmt.Errorf("profile TCP option '%s' must be one of: mss, sack_perm, ts, nop, ws, eol", o))
+			}
+			size += n
+		}
+		if size > 40 {
+			errors = append(errors, fmt.Errorf("profile TCP options %v exceed 40 bytes", layout))
+		}
+	}
+
+	return errors
+}
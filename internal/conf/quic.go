@@ -0,0 +1,81 @@
+package conf
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type QUIC struct {
+	Key        string `yaml:"key"`
+	MTU        int    `yaml:"mtu"`
+	MaxStreams int    `yaml:"max_streams"`
+	Streambuf  int    `yaml:"streambuf"`
+	Connbuf    int    `yaml:"connbuf"`
+
+	IdleTimeout_ int `yaml:"idle_timeout"`
+	Keepalive_   int `yaml:"keepalive"`
+
+	IdleTimeout time.Duration `yaml:"-"`
+	Keepalive   time.Duration `yaml:"-"`
+	Secret      []byte        `yaml:"-"`
+}
+
+func (q *QUIC) setDefaults() {
+	if q.MTU == 0 {
+		q.MTU = 1350
+	}
+	if q.MaxStreams == 0 {
+		q.MaxStreams = 1024
+	}
+	if q.Streambuf == 0 {
+		q.Streambuf = 2 * 1024 * 1024
+	}
+	if q.Connbuf == 0 {
+		q.Connbuf = 8 * 1024 * 1024
+	}
+
+	if q.IdleTimeout_ == 0 {
+		q.IdleTimeout_ = 30
+	}
+	if q.Keepalive_ == 0 {
+		q.Keepalive_ = 10
+	}
+}
+
+func (q *QUIC) validate() []error {
+	var errors []error
+
+	if len(q.Key) == 0 {
+		errors = append(errors, fmt.Errorf("QUIC key is required"))
+	}
+	q.Secret = pbkdf2.Key([]byte(q.Key), []byte("paqet-quic"), 100_000, 32, sha256.New)
+
+	// QUIC needs 1200 bytes for its first packets, and the crafted TCP
+	// headers must still fit in the link MTU.
+	if q.MTU < 1200 || q.MTU > 1452 {
+		errors = append(errors, fmt.Errorf("QUIC MTU must be between 1200-1452 bytes"))
+	}
+	if q.MaxStreams < 1 || q.MaxStreams > 65535 {
+		errors = append(errors, fmt.Errorf("QUIC max_streams must be between 1-65535"))
+	}
+	if q.Streambuf < 1024 {
+		errors = append(errors, fmt.Errorf("QUIC streambuf must be >= 1024 bytes"))
+	}
+	if q.Connbuf < q.Streambuf {
+		errors = append(errors, fmt.Errorf("QUIC connbuf must be >= streambuf"))
+	}
+
+	if q.IdleTimeout_ < 1 || q.IdleTimeout_ > 600 {
+		errors = append(errors, fmt.Errorf("QUIC idle_timeout must be between 1-600 seconds"))
+	}
+	if q.Keepalive_ < 1 || q.Keepalive_ >= q.IdleTimeout_ {
+		errors = append(errors, fmt.Errorf("QUIC keepalive must be at least 1 second and below idle_timeout"))
+	}
+	q.IdleTimeout = time.Duration(q.IdleTimeout_) * time.Second
+	q.Keepalive = time.Duration(q.Keepalive_) * time.Second
+
+	return errors
+}
@@ -0,0 +1,96 @@
+package conf
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Stream configures the fallback transport, which runs the smux session over
+// a kernel TCP connection, optionally wrapped in TLS or WebSocket.
+type Stream struct {
+	Mode       string `yaml:"mode"`
+	Path       string `yaml:"path"`
+	Key        string `yaml:"key"`
+	Cert       string `yaml:"cert"`
+	CertKey    string `yaml:"cert_key"`
+	ServerName string `yaml:"server_name"`
+	Insecure   bool   `yaml:"insecure"`
+
+	Smuxbuf   int `yaml:"smuxbuf"`
+	Streambuf int `yaml:"streambuf"`
+
+	Smuxkalive_   int `yaml:"smuxkalive"`
+	Smuxktimeout_ int `yaml:"smuxktimeout"`
+
+	Smuxkalive   time.Duration    `yaml:"-"`
+	Smuxktimeout time.Duration    `yaml:"-"`
+	Secret       []byte           `yaml:"-"`
+	Certificate  *tls.Certificate `yaml:"-"`
+}
+
+func (s *Stream) setDefaults() {
+	if s.Mode == "" {
+		s.Mode = "tls"
+	}
+	if s.Path == "" {
+		s.Path = "/"
+	}
+
+	if s.Smuxbuf == 0 {
+		s.Smuxbuf = 4 * 1024 * 1024
+	}
+	if s.Streambuf == 0 {
+		s.Streambuf = 2 * 1024 * 1024
+	}
+
+	if s.Smuxkalive_ == 0 {
+		s.Smuxkalive_ = 2
+	}
+	if s.Smuxktimeout_ == 0 {
+		s.Smuxktimeout_ = 8
+	}
+}
+
+func (s *Stream) validate() []error {
+	var errors []error
+
+	validModes := []string{"tcp", "tls", "ws", "wss"}
+	if !slices.Contains(validModes, s.Mode) {
+		errors = append(errors, fmt.Errorf("stream mode must be one of: %v", validModes))
+	}
+	if len(s.Path) == 0 || s.Path[0] != '/' {
+		errors = append(errors, fmt.Errorf("stream path must start with '/'"))
+	}
+
+	if len(s.Key) == 0 {
+		errors = append(errors, fmt.Errorf("stream key is required"))
+	}
+	s.Secret = pbkdf2.Key([]byte(s.Key), []byte("paqet-stream"), 100_000, 32, sha256.New)
+
+	if (s.Cert == "") != (s.CertKey == "") {
+		errors = append(errors, fmt.Errorf("stream cert and cert_key must be set together"))
+	} else if s.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.CertKey)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("failed to load stream certificate: %v", err))
+		}
+		s.Certificate = &cert
+	}
+
+	if s.Smuxbuf < 1024 {
+		errors = append(errors, fmt.Errorf("stream smuxbuf must be >= 1024 bytes"))
+	}
+	if s.Streambuf < 1024 {
+		errors = append(errors, fmt.Errorf("stream streambuf must be >= 1024 bytes"))
+	}
+
+	s.Smuxkalive = time.Duration(s.Smuxkalive_) * time.Second
+	s.Smuxktimeout = time.Duration(s.Smuxktimeout_) * time.Second
+
+	return errors
+}
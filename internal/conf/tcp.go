@@ -5,10 +5,14 @@ import (
 )
 
 type TCP struct {
-	LF_ []string `yaml:"local_flag"`
-	RF_ []string `yaml:"remote_flag"`
-	LF  []TCPF   `yaml:"-"`
-	RF  []TCPF   `yaml:"-"`
+	LF_       []string     `yaml:"local_flag"`
+	RF_       []string     `yaml:"remote_flag"`
+	Handshake bool         `yaml:"handshake"`
+	Profile_  string       `yaml:"profile"`
+	Custom    *Fingerprint `yaml:"custom"`
+	LF        []TCPF       `yaml:"-"`
+	RF        []TCPF       `yaml:"-"`
+	Profile   Fingerprint  `yaml:"-"`
 }
 
 type TCPF struct {
@@ -22,6 +26,9 @@ func (t *TCP) setDefaults() {
 	if len(t.RF_) == 0 {
 		t.RF_ = []string{"PA"}
 	}
+	if t.Profile_ == "" {
+		t.Profile_ = "linux"
+	}
 }
 
 func (t *TCP) validate() []error {
@@ -52,6 +59,22 @@ func (t *TCP) validate() []error {
 		errors = append(errors, fmt.Errorf("at least one TCP flag combination required"))
 	}
 
+	switch t.Profile_ {
+	case "custom":
+		if t.Custom == nil {
+			t.Custom = &Fingerprint{}
+		}
+		t.Custom.setDefaults(profiles["linux"])
+		t.Profile = *t.Custom
+		errors = append(errors, t.Profile.validate()...)
+	default:
+		p, ok := profiles[t.Profile_]
+		if !ok {
+			errors = append(errors, fmt.Errorf("TCP profile must be one of: linux, windows, macos, custom"))
+		}
+		t.Profile = p
+	}
+
 	maxTCPFLen := 64
 	if len(t.LF_) > maxTCPFLen {
 		errors = append(errors, fmt.Errorf("local_flag exceeds max %d", maxTCPFLen))
@@ -6,12 +6,18 @@ import (
 )
 
 type Transport struct {
-	Protocol string `yaml:"protocol"`
-	Conn     int    `yaml:"conn"`
-	KCP      *KCP   `yaml:"kcp"`
+	Protocol string  `yaml:"protocol"`
+	Carrier  string  `yaml:"carrier"`
+	Conn     int     `yaml:"conn"`
+	KCP      *KCP    `yaml:"kcp"`
+	Stream   *Stream `yaml:"stream"`
+	QUIC     *QUIC   `yaml:"quic"`
 }
 
 func (t *Transport) setDefaults(role string) {
+	if t.Carrier == "" {
+		t.Carrier = "raw"
+	}
 	if t.Conn == 0 {
 		t.Conn = 1
 	}
@@ -21,17 +27,30 @@ func (t *Transport) setDefaults(role string) {
 		if t.KCP != nil {
 			t.KCP.setDefaults(role)
 		}
+	case "stream":
+		if t.Stream != nil {
+			t.Stream.setDefaults()
+		}
+	case "quic":
+		if t.QUIC != nil {
+			t.QUIC.setDefaults()
+		}
 	}
 }
 
 func (t *Transport) validate() []error {
 	var errors []error
 
-	validProtocols := []string{"kcp"}
+	validProtocols := []string{"kcp", "quic", "stream"}
 	if !slices.Contains(validProtocols, t.Protocol) {
 		errors = append(errors, fmt.Errorf("transport protocol must be one of: %v", validProtocols))
 	}
 
+	validCarriers := []string{"raw", "udp"}
+	if !slices.Contains(validCarriers, t.Carrier) {
+		errors = append(errors, fmt.Errorf("transport carrier must be one of: %v", validCarriers))
+	}
+
 	if t.Conn < 1 || t.Conn > 256 {
 		errors = append(errors, fmt.Errorf("KCP conn must be between 1-256 connections"))
 	}
@@ -43,6 +62,18 @@ func (t *Transport) validate() []error {
 		} else {
 			errors = append(errors, t.KCP.validate()...)
 		}
+	case "stream":
+		if t.Stream == nil {
+			errors = append(errors, fmt.Errorf("transport.stream configuration is required"))
+		} else {
+			errors = append(errors, t.Stream.validate()...)
+		}
+	case "quic":
+		if t.QUIC == nil {
+			errors = append(errors, fmt.Errorf("transport.quic configuration is required"))
+		} else {
+			errors = append(errors, t.QUIC.validate()...)
+		}
 	}
 
 	return errors
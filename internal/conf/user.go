@@ -0,0 +1,42 @@
+package conf
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// User is a credential a client presents once its transport is up. The
+// server lists every accepted user; a client names the one it connects as.
+type User struct {
+	Name   string `yaml:"name"`
+	Key    string `yaml:"key"`
+	Rate   int    `yaml:"rate"`
+	ACL    []Rule `yaml:"acl"`
+	Secret []byte `yaml:"-"`
+}
+
+func (u *User) setDefaults() {}
+func (u *User) validate() []error {
+	var errors []error
+
+	if len(u.Name) == 0 || len(u.Name) > 64 {
+		errors = append(errors, fmt.Errorf("name must be between 1-64 characters"))
+	}
+	if len(u.Key) == 0 {
+		errors = append(errors, fmt.Errorf("key is required"))
+	}
+	if u.Rate < 0 {
+		errors = append(errors, fmt.Errorf("rate must not be negative"))
+	}
+	u.Secret = pbkdf2.Key([]byte(u.Key), []byte("paqet-user"), 100_000, 32, sha256.New)
+
+	for i := range u.ACL {
+		for _, err := range u.ACL[i].validate() {
+			errors = append(errors, fmt.Errorf("acl[%d] %v", i, err))
+		}
+	}
+
+	return errors
+}
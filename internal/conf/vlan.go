@@ -0,0 +1,30 @@
+package conf
+
+import (
+	"fmt"
+)
+
+type VLAN struct {
+	ID       int `yaml:"id"`
+	Priority int `yaml:"priority"`
+	Outer    int `yaml:"outer"`
+}
+
+func (v *VLAN) validate() []error {
+	var errors []error
+
+	if v.ID < 0 || v.ID > 4094 {
+		errors = append(errors, fmt.Errorf("VLAN id must be between 1-4094"))
+	}
+	if v.Priority < 0 || v.Priority > 7 {
+		errors = append(errors, fmt.Errorf("VLAN priority must be between 0-7"))
+	}
+	if v.Outer < 0 || v.Outer > 4094 {
+		errors = append(errors, fmt.Errorf("VLAN outer id must be between 1-4094"))
+	}
+	if v.Outer != 0 && v.ID == 0 {
+		errors = append(errors, fmt.Errorf("VLAN outer id requires an inner id"))
+	}
+
+	return errors
+}
@@ -30,13 +30,13 @@ func (f *Forward) serveTCP(ctx context.Context, listener net.Listener) {
 }
 
 func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) {
-	strm, err := f.client.TCP(ctx, f.targetAddr)
+	strm, bound, err := f.client.TCP(ctx, f.targetAddr)
 	if err != nil {
 		flog.Errorf("failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), f.targetAddr, err)
 		return
 	}
 	defer strm.Close()
-	flog.Infof("accepted TCP connection %s -> %s", conn.RemoteAddr(), f.targetAddr)
+	flog.Infof("accepted TCP connection %s -> %s (server bound %s)", conn.RemoteAddr(), f.targetAddr, bound)
 
 	errCh := make(chan error, 2)
 	go func() { errCh <- buffer.CopyT(conn, strm) }()
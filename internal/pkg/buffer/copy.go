@@ -7,7 +7,8 @@ import (
 
 const (
 	TCPSize = 8 * 1024
-	UDPSize = 4 * 1024
+	// UDPSize is the largest UDP payload over IPv4.
+	UDPSize = 65507
 	_       = uint(0xFFFF - UDPSize)
 )
 
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/tnet"
+)
+
+// AssocStrm carries the datagrams of a UDP association, which are not tied
+// to one destination: each is prefixed with the address it goes to, or on
+// the way back, the address it came from.
+type AssocStrm struct {
+	*UDPStrm
+	wmu  sync.Mutex
+	wbuf []byte
+	rmu  sync.Mutex
+	rbuf []byte
+}
+
+func NewAssocStrm(strm *UDPStrm) *AssocStrm {
+	return &AssocStrm{UDPStrm: strm, rbuf: make([]byte, maxFrame)}
+}
+
+// ErrDatagramSize is returned, wrapped, for a datagram too large to send.
+var ErrDatagramSize = errors.New("protocol: datagram too large")
+
+// WriteTo sends p as a datagram for addr. The address shares the frame with
+// p, so p may hold at most buffer.UDPSize bytes and no more than the frame
+// has room for after the address.
+func (s *AssocStrm) WriteTo(p []byte, addr *tnet.Addr) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	b, err := appendAddr(s.wbuf[:0], addr)
+	if err != nil {
+		return err
+	}
+	if limit := min(buffer.UDPSize, maxFrame-len(b)); len(p) > limit {
+		return fmt.Errorf("%w: %d bytes for %s, max %d", ErrDatagramSize, len(p), addr, limit)
+	}
+	s.wbuf = append(b, p...)
+	return s.send(s.wbuf)
+}
+
+// ReadFrom returns the next datagram and its address, truncated like Read
+// if p is short.
+func (s *AssocStrm) ReadFrom(p []byte) (int, *tnet.Addr, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	n, err := s.UDPStrm.Read(s.rbuf)
+	if err != nil {
+		return 0, nil, err
+	}
+	addr, data, err := splitAddr(s.rbuf[:n])
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, data), addr, nil
+}
+
+// splitAddr reads the address at the start of b, returning it and the rest
+// of b.
+func splitAddr(b []byte) (*tnet.Addr, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0])+2 {
+		return nil, nil, errors.New("protocol: truncated datagram address")
+	}
+	n := 1 + int(b[0]) + 2
+	addr, err := readAddr(b[:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, b[n:], nil
+}
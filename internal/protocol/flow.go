@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"paqet/internal/tnet"
+)
+
+// Flows carries the datagrams of UDP streams over a DatagramConn. Each
+// datagram starts with the 4-byte ID of the stream it belongs to; the
+// stream itself stays open for those too large to send this way.
+type Flows struct {
+	conn  tnet.DatagramConn
+	mu    sync.Mutex
+	flows map[uint32]chan []byte
+}
+
+// NewFlows starts dispatching the datagrams received on conn until it is
+// closed.
+func NewFlows(conn tnet.DatagramConn) *Flows {
+	f := &Flows{conn: conn, flows: make(map[uint32]chan []byte)}
+	go f.read()
+	return f
+}
+
+func (f *Flows) read() {
+	for {
+		b, err := f.conn.ReceiveDatagram()
+		if err != nil {
+			return
+		}
+		if len(b) < 4 {
+			continue
+		}
+		f.mu.Lock()
+		ch := f.flows[binary.BigEndian.Uint32(b)]
+		f.mu.Unlock()
+		if ch == nil {
+			continue
+		}
+		select {
+		case ch <- b[4:]:
+		default:
+		}
+	}
+}
+
+func (f *Flows) open(id uint32, ch chan []byte) {
+	f.mu.Lock()
+	f.flows[id] = ch
+	f.mu.Unlock()
+}
+
+func (f *Flows) close(id uint32) {
+	f.mu.Lock()
+	delete(f.flows, id)
+	f.mu.Unlock()
+}
+
+func (f *Flows) send(id uint32, p []byte) error {
+	b := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(b, id)
+	copy(b[4:], p)
+	return f.conn.SendDatagram(b)
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Features are the optional parts of the protocol a peer understands.
+// Each is used on a connection only if both ends list it in their PHELO.
+type Features uint32
+
+const (
+	// FRESULT: the server answers a PTCP that asks for it with a PRSLT
+	// before relaying.
+	FRESULT Features = 1 << iota
+	// FDATAGRAM: PDGRM streams, with datagrams beside the connection.
+	FDATAGRAM
+	// FASSOC: PASOC streams for UDP associations.
+	FASSOC
+	// FCONTROL: a PCTRL stream for TCPF, keepalives and server notices.
+	FCONTROL
+	// FFRAMING: PUDP datagrams are length-prefixed on the stream.
+	FFRAMING
+
+	// SUPPORTED is every feature this build implements.
+	SUPPORTED = FRESULT | FDATAGRAM | FASSOC | FCONTROL | FFRAMING
+)
+
+var featureNames = []string{"result", "datagram", "assoc", "control", "framing"}
+
+func (f Features) Has(o Features) bool { return f&o == o }
+
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if unknown := f &^ SUPPORTED; unknown != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(unknown)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// NewHello returns the PHELO this build sends.
+func NewHello() Proto {
+	return Proto{Type: PHELO, MinVer: MINVERSION, MaxVer: VERSION, Features: SUPPORTED}
+}
+
+// Negotiate returns the newest version and the features that both the
+// local and remote hellos support.
+func Negotiate(local, remote *Proto) (byte, Features, error) {
+	lo, hi := max(local.MinVer, remote.MinVer), min(local.MaxVer, remote.MaxVer)
+	if lo > hi {
+		return 0, 0, fmt.Errorf("no common protocol version: peer speaks %d-%d, this build %d-%d",
+			remote.MinVer, remote.MaxVer, local.MinVer, local.MaxVer)
+	}
+	return hi, local.Features & remote.Features, nil
+}
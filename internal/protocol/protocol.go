@@ -1,10 +1,13 @@
 package protocol
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"paqet/internal/conf"
 	"paqet/internal/tnet"
@@ -16,17 +19,57 @@ const (
 	MAGIC   byte = 0x50
 	VERSION byte = 0x01
 
+	// MINVERSION is the oldest version this build still speaks.
+	MINVERSION byte = 0x01
+
 	PPING PType = 0x01
 	PPONG PType = 0x02
 	PTCPF PType = 0x03
 	PTCP  PType = 0x04
 	PUDP  PType = 0x05
+	PAUTH PType = 0x06
+	PRSLT PType = 0x07
+	PDGRM PType = 0x08
+	PASOC PType = 0x09
+	PHELO PType = 0x0A
+	PCTRL PType = 0x0B
+	PNOTE PType = 0x0C
+)
+
+// Notices a server sends on the control stream with PNOTE.
+const (
+	// NGOAWAY: the server is shutting down; the connection is closed after
+	// the delay.
+	NGOAWAY byte = 0x01
+	// NREVOKED: the user's credentials were withdrawn.
+	NREVOKED byte = 0x02
+	// NRATELIMIT: new streams are refused for the delay.
+	NRATELIMIT byte = 0x03
 )
 
+// Dial results carried by PRSLT. Codes up to RREFUSED share their SOCKS5
+// reply values.
+const (
+	RSUCCESS     byte = 0x00
+	RFAILURE     byte = 0x01
+	RDENIED      byte = 0x02
+	RNETUNREACH  byte = 0x03
+	RHOSTUNREACH byte = 0x04
+	RREFUSED     byte = 0x05
+	RTIMEOUT     byte = 0x06
+	RDNS         byte = 0x07
+)
+
+// tcpReply follows the address of a PTCP that asks for a PRSLT. Servers
+// that predate dial results reject the longer body and close the stream.
+const tcpReply byte = 0x01
+
 const (
 	headerLen    = 5 // MAGIC, VERSION, TYPE, LENGTH(2)
 	maxHostLen   = 253
 	maxTCPFCount = 64
+	maxUserLen   = 64
+	maxAuthLen   = 64
 	maxBodyLen   = 4096
 	maxPort      = 0xFFFF
 )
@@ -47,6 +90,21 @@ type Proto struct {
 	Type PType
 	Addr *tnet.Addr
 	TCPF []conf.TCPF
+	User string
+	Auth []byte
+	Code byte
+	// Reply asks the server to answer a PTCP with a PRSLT.
+	Reply bool
+	// Ver is the version a message is written with, MINVERSION if unset,
+	// or the one it was read with. A PHELO is always written with
+	// MINVERSION, so that a peer of any version can read it.
+	Ver byte
+
+	MinVer   byte
+	MaxVer   byte
+	Features Features
+
+	Delay time.Duration
 }
 
 func encodeTCPF(f conf.TCPF) uint16 {
@@ -97,27 +155,60 @@ func readFull(r io.Reader, n int) ([]byte, error) {
 	return b, nil
 }
 
+func appendAddr(body []byte, a *tnet.Addr) ([]byte, error) {
+	host := []byte(a.Host)
+	if len(host) > maxHostLen {
+		return nil, fmt.Errorf("protocol: host length %d exceeds max %d", len(host), maxHostLen)
+	}
+	if a.Port < 0 || a.Port > maxPort {
+		return nil, fmt.Errorf("protocol: port %d out of range", a.Port)
+	}
+	body = append(body, byte(len(host)))
+	body = append(body, host...)
+	body = binary.BigEndian.AppendUint16(body, uint16(a.Port))
+	return body, nil
+}
+
+func readAddr(body []byte) (*tnet.Addr, error) {
+	if len(body) < 3 {
+		return nil, errors.New("protocol: truncated address body")
+	}
+	hl := int(body[0])
+	if hl > maxHostLen || 1+hl+2 != len(body) {
+		return nil, fmt.Errorf("protocol: bad host length %d", hl)
+	}
+	host := string(body[1 : 1+hl])
+	port := int(binary.BigEndian.Uint16(body[1+hl:]))
+	return &tnet.Addr{Host: host, Port: port}, nil
+}
+
 func (p *Proto) Write(w io.Writer) error {
 	body := make([]byte, 0, 64)
 
 	switch p.Type {
-	case PPING, PPONG:
+	case PPING, PPONG, PASOC, PCTRL:
 		// no body
 
-	case PTCP, PUDP:
+	case PTCP, PUDP, PDGRM:
 		if p.Addr == nil {
 			return errors.New("protocol: address required")
 		}
-		host := []byte(p.Addr.Host)
-		if len(host) > maxHostLen {
-			return fmt.Errorf("protocol: host length %d exceeds max %d", len(host), maxHostLen)
+		var err error
+		if body, err = appendAddr(body, p.Addr); err != nil {
+			return err
 		}
-		if p.Addr.Port < 0 || p.Addr.Port > maxPort {
-			return fmt.Errorf("protocol: port %d out of range", p.Addr.Port)
+		if p.Type == PTCP && p.Reply {
+			body = append(body, tcpReply)
+		}
+
+	case PRSLT:
+		body = append(body, p.Code)
+		if p.Addr != nil {
+			var err error
+			if body, err = appendAddr(body, p.Addr); err != nil {
+				return err
+			}
 		}
-		body = append(body, byte(len(host)))
-		body = append(body, host...)
-		body = binary.BigEndian.AppendUint16(body, uint16(p.Addr.Port))
 
 	case PTCPF:
 		if len(p.TCPF) > maxTCPFCount {
@@ -128,6 +219,26 @@ func (p *Proto) Write(w io.Writer) error {
 			body = binary.BigEndian.AppendUint16(body, encodeTCPF(f))
 		}
 
+	case PNOTE:
+		body = append(body, p.Code)
+		body = binary.BigEndian.AppendUint32(body, uint32(p.Delay/time.Millisecond))
+
+	case PHELO:
+		body = append(body, p.MinVer, p.MaxVer)
+		body = binary.BigEndian.AppendUint32(body, uint32(p.Features))
+
+	case PAUTH:
+		if len(p.User) > maxUserLen {
+			return fmt.Errorf("protocol: user length %d exceeds max %d", len(p.User), maxUserLen)
+		}
+		if len(p.Auth) > maxAuthLen {
+			return fmt.Errorf("protocol: auth length %d exceeds max %d", len(p.Auth), maxAuthLen)
+		}
+		body = append(body, byte(len(p.User)))
+		body = append(body, p.User...)
+		body = append(body, byte(len(p.Auth)))
+		body = append(body, p.Auth...)
+
 	default:
 		return errors.New("protocol: unknown message type")
 	}
@@ -137,7 +248,11 @@ func (p *Proto) Write(w io.Writer) error {
 	}
 
 	buf := make([]byte, 0, headerLen+len(body))
-	buf = append(buf, MAGIC, VERSION, p.Type)
+	ver := p.Ver
+	if ver == 0 || p.Type == PHELO {
+		ver = MINVERSION
+	}
+	buf = append(buf, MAGIC, ver, p.Type)
 	buf = binary.BigEndian.AppendUint16(buf, uint16(len(body)))
 	buf = append(buf, body...)
 
@@ -153,11 +268,15 @@ func (p *Proto) Read(r io.Reader) error {
 	if hdr[0] != MAGIC {
 		return fmt.Errorf("protocol: bad magic byte 0x%02x (want 0x%02x)", hdr[0], MAGIC)
 	}
-	if hdr[1] != VERSION {
-		return fmt.Errorf("protocol: unsupported version 0x%02x (want 0x%02x)", hdr[1], VERSION)
+	// A PHELO is how peers find a version in common, so it is read
+	// whatever version it carries.
+	if hdr[2] != PHELO && (hdr[1] < MINVERSION || hdr[1] > VERSION) {
+		return fmt.Errorf("protocol: unsupported version 0x%02x (want 0x%02x-0x%02x)", hdr[1], MINVERSION, VERSION)
 	}
-	p.Type = hdr[2]
-	p.Addr, p.TCPF = nil, nil
+	p.Ver, p.Type = hdr[1], hdr[2]
+	p.Addr, p.TCPF, p.User, p.Auth, p.Code = nil, nil, "", nil, 0
+	p.Reply = false
+	p.MinVer, p.MaxVer, p.Features, p.Delay = 0, 0, 0, 0
 
 	n := int(binary.BigEndian.Uint16(hdr[3:]))
 	if n > maxBodyLen {
@@ -169,22 +288,35 @@ func (p *Proto) Read(r io.Reader) error {
 	}
 
 	switch p.Type {
-	case PPING, PPONG:
+	case PPING, PPONG, PASOC, PCTRL:
 		return nil
 
-	case PTCP, PUDP:
-		if len(body) < 3 {
-			return errors.New("protocol: truncated address body")
+	case PNOTE:
+		if len(body) != 5 {
+			return errors.New("protocol: bad notice body")
 		}
-		hl := int(body[0])
-		if hl > maxHostLen || 1+hl+2 != len(body) {
-			return fmt.Errorf("protocol: bad host length %d", hl)
-		}
-		host := string(body[1 : 1+hl])
-		port := int(binary.BigEndian.Uint16(body[1+hl:]))
-		p.Addr = &tnet.Addr{Host: host, Port: port}
+		p.Code = body[0]
+		p.Delay = time.Duration(binary.BigEndian.Uint32(body[1:])) * time.Millisecond
 		return nil
 
+	case PTCP, PUDP, PDGRM:
+		if p.Type == PTCP && len(body) > 0 && len(body) == 1+int(body[0])+2+1 {
+			p.Reply = body[len(body)-1]&tcpReply != 0
+			body = body[:len(body)-1]
+		}
+		p.Addr, err = readAddr(body)
+		return err
+
+	case PRSLT:
+		if len(body) < 1 {
+			return errors.New("protocol: truncated result body")
+		}
+		p.Code = body[0]
+		if len(body) > 1 {
+			p.Addr, err = readAddr(body[1:])
+		}
+		return err
+
 	case PTCPF:
 		if len(body) < 1 {
 			return errors.New("protocol: truncated tcpf body")
@@ -199,7 +331,88 @@ func (p *Proto) Read(r io.Reader) error {
 		}
 		return nil
 
+	case PAUTH:
+		if len(body) < 2 {
+			return errors.New("protocol: truncated auth body")
+		}
+		ul := int(body[0])
+		if ul > maxUserLen || 1+ul+1 > len(body) {
+			return fmt.Errorf("protocol: bad user length %d", ul)
+		}
+		al := int(body[1+ul])
+		if al > maxAuthLen || 1+ul+1+al != len(body) {
+			return fmt.Errorf("protocol: bad auth length %d", al)
+		}
+		p.User = string(body[1 : 1+ul])
+		p.Auth = body[2+ul:]
+		return nil
+
+	case PHELO:
+		// Later versions may append to the body, so only its start is read.
+		if len(body) < 6 {
+			return errors.New("protocol: truncated hello body")
+		}
+		p.MinVer, p.MaxVer = body[0], body[1]
+		p.Features = Features(binary.BigEndian.Uint32(body[2:]))
+		return nil
+
 	default:
 		return errors.New("protocol: unknown message type")
 	}
 }
+
+// Ping sends a PPING on rw and waits for the PPONG.
+func Ping(rw io.ReadWriter) error {
+	p := Proto{Type: PPING}
+	if err := p.Write(rw); err != nil {
+		return fmt.Errorf("strm ping write failed: %w", err)
+	}
+	if err := p.Read(rw); err != nil {
+		return fmt.Errorf("strm ping read failed: %w", err)
+	}
+	if p.Type != PPONG {
+		return fmt.Errorf("strm pong failed: unexpected type %d", p.Type)
+	}
+	return nil
+}
+
+// AuthMAC is a user's answer to the server's challenge.
+func AuthMAC(secret, challenge []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte("paqet-user"))
+	m.Write(challenge)
+	return m.Sum(nil)
+}
+
+// ServerAuthMAC is the server's answer to the client's challenge, bound to
+// the challenge it sent the client so it cannot be replayed across sessions.
+func ServerAuthMAC(secret, challenge, clientChallenge []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte("paqet-server"))
+	m.Write(challenge)
+	m.Write(clientChallenge)
+	return m.Sum(nil)
+}
+
+// DialError is a failed PRSLT: the server could not reach the destination.
+type DialError struct {
+	Code byte
+}
+
+func (e *DialError) Error() string {
+	switch e.Code {
+	case RDENIED:
+		return "server denied the destination"
+	case RNETUNREACH:
+		return "network unreachable from server"
+	case RHOSTUNREACH:
+		return "host unreachable from server"
+	case RREFUSED:
+		return "connection refused"
+	case RTIMEOUT:
+		return "server timed out connecting"
+	case RDNS:
+		return "server could not resolve the host"
+	}
+	return "server failed to connect"
+}
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/tnet"
+)
+
+const maxFrame = 0xFFFF
+
+// UDPStrm carries datagrams over a PUDP stream, each prefixed with its
+// 2-byte length. The stream underneath may split or merge writes, so the
+// framing is what keeps datagram boundaries intact.
+//
+// A UDPStrm opened with Flows sends datagrams unreliably instead, falling
+// back to the stream for those the connection cannot take, and reads from
+// both. One opened raw copies datagrams to and from the stream unframed, as
+// peers that predate framing expect.
+type UDPStrm struct {
+	tnet.Strm
+	raw  bool
+	rmu  sync.Mutex
+	wmu  sync.Mutex
+	wbuf []byte
+
+	flows *Flows
+	id    uint32
+	in    chan []byte
+	dead  chan struct{}
+	done  chan struct{}
+	err   error
+	once  sync.Once
+	dmu   sync.Mutex
+	rdl   time.Time
+}
+
+func NewUDPStrm(strm tnet.Strm) *UDPStrm {
+	return &UDPStrm{Strm: strm}
+}
+
+// NewRawUDPStrm returns a UDPStrm that does not frame its datagrams, so
+// their boundaries hold only as far as the stream keeps them.
+func NewRawUDPStrm(strm tnet.Strm) *UDPStrm {
+	return &UDPStrm{Strm: strm, raw: true}
+}
+
+// NewFlowStrm returns a UDPStrm for a PDGRM stream, whose datagrams travel
+// on flows under the stream's ID.
+func NewFlowStrm(strm tnet.Strm, flows *Flows) *UDPStrm {
+	s := &UDPStrm{
+		Strm:  strm,
+		flows: flows,
+		id:    uint32(strm.SID()),
+		in:    make(chan []byte, 256),
+		dead:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	flows.open(s.id, s.in)
+	go s.pump()
+	return s
+}
+
+// pump moves the datagrams that came over the stream to in.
+func (s *UDPStrm) pump() {
+	buf := make([]byte, maxFrame)
+	for {
+		n, err := s.readFrame(buf)
+		if err != nil {
+			s.err = err
+			close(s.dead)
+			return
+		}
+		select {
+		case s.in <- append([]byte(nil), buf[:n]...):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Write sends p as one datagram of at most buffer.UDPSize bytes.
+func (s *UDPStrm) Write(p []byte) (int, error) {
+	if len(p) > buffer.UDPSize {
+		return 0, fmt.Errorf("protocol: datagram of %d bytes exceeds max %d", len(p), buffer.UDPSize)
+	}
+	if s.raw {
+		return s.Strm.Write(p)
+	}
+	if err := s.send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send writes p as one frame, which the length prefix limits to maxFrame
+// bytes.
+func (s *UDPStrm) send(p []byte) error {
+	if len(p) > maxFrame {
+		return fmt.Errorf("protocol: frame of %d bytes exceeds max %d", len(p), maxFrame)
+	}
+	if s.flows != nil && s.flows.send(s.id, p) == nil {
+		return nil
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.wbuf = binary.BigEndian.AppendUint16(s.wbuf[:0], uint16(len(p)))
+	s.wbuf = append(s.wbuf, p...)
+	_, err := s.Strm.Write(s.wbuf)
+	return err
+}
+
+// Read returns the next datagram. As with a UDP socket, a datagram longer
+// than p is truncated.
+func (s *UDPStrm) Read(p []byte) (int, error) {
+	if s.raw {
+		return s.Strm.Read(p)
+	}
+	if s.flows == nil {
+		return s.readFrame(p)
+	}
+	var timeout <-chan time.Time
+	if d := s.readDeadline(); !d.IsZero() {
+		t := time.NewTimer(time.Until(d))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case b := <-s.in:
+		return copy(p, b), nil
+	case <-s.dead:
+		return 0, s.err
+	case <-s.done:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// A flow's stream is read by its pump, so read deadlines apply to Read
+// alone rather than to the stream.
+func (s *UDPStrm) SetReadDeadline(t time.Time) error {
+	if s.flows == nil {
+		return s.Strm.SetReadDeadline(t)
+	}
+	s.dmu.Lock()
+	s.rdl = t
+	s.dmu.Unlock()
+	return nil
+}
+
+func (s *UDPStrm) SetDeadline(t time.Time) error {
+	if s.flows == nil {
+		return s.Strm.SetDeadline(t)
+	}
+	s.SetReadDeadline(t)
+	return s.Strm.SetWriteDeadline(t)
+}
+
+func (s *UDPStrm) readDeadline() time.Time {
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
+	return s.rdl
+}
+
+func (s *UDPStrm) readFrame(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	var hdr [2]byte
+	if _, err := io.ReadFull(s.Strm, hdr[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[:]))
+	n := min(size, len(p))
+	if _, err := io.ReadFull(s.Strm, p[:n]); err != nil {
+		return 0, err
+	}
+	if n < size {
+		if _, err := io.CopyN(io.Discard, s.Strm, int64(size-n)); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (s *UDPStrm) Close() error {
+	if s.flows != nil {
+		s.once.Do(func() {
+			s.flows.close(s.id)
+			close(s.done)
+		})
+	}
+	return s.Strm.Close()
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/tnet"
+)
+
+// aclError reports the rule that denied a destination.
+type aclError struct {
+	rule string
+}
+
+func (e *aclError) Error() string {
+	return "denied by " + e.rule
+}
+
+// SetACL replaces the server-wide egress rules, which apply after those
+// of the connecting user.
+func (s *Server) SetACL(rules []conf.Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acl = rules
+	flog.Infof("loaded %d ACL rules", len(rules))
+}
+
+// egress returns the address to dial for a client's request to reach addr
+// over proto. Names are resolved first so that rules see the addresses
+// actually dialed, and the first address the rules allow is used.
+func (s *Server) egress(ctx context.Context, conn tnet.Conn, proto string, addr *tnet.Addr) (string, error) {
+	name := tnet.User(conn)
+	s.mu.Lock()
+	user, global := s.users[name].ACL, s.acl
+	s.mu.Unlock()
+	if len(user) == 0 && len(global) == 0 {
+		return addr.String(), nil
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(addr.Host), ".")
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips, host = []netip.Addr{ip}, ""
+	} else {
+		ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return "", err
+		}
+		if len(ips) == 0 {
+			return "", fmt.Errorf("no addresses for %s", host)
+		}
+	}
+
+	var denied error
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		rule := check(user, "users."+name+".acl", proto, host, ip, addr.Port)
+		if rule == nil {
+			rule = check(global, "acl", proto, host, ip, addr.Port)
+		}
+		if rule == nil || rule.action == "allow" {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)), nil
+		}
+		if denied == nil {
+			denied = &aclError{rule: rule.label}
+		}
+	}
+	return "", denied
+}
+
+type matched struct {
+	action string
+	label  string
+}
+
+// check returns the first rule in rules that matches, or nil if none does.
+func check(rules []conf.Rule, prefix, proto, host string, ip netip.Addr, port int) *matched {
+	for i := range rules {
+		if rules[i].Match(proto, host, ip, port) {
+			return &matched{
+				action: rules[i].Action,
+				label:  fmt.Sprintf("%s[%d] (%s)", prefix, i, rules[i].String()),
+			}
+		}
+	}
+	return nil
+}
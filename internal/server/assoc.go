@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+const (
+	assocDestTTL       = 60 * time.Second
+	assocDestMax       = 4096
+	assocLookupTimeout = 5 * time.Second
+)
+
+// assocDest is where datagrams for one requested address go; addr is nil
+// while it is being looked up and when they are dropped.
+type assocDest struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+// handleAssocProtocol relays a UDP association through one unconnected
+// socket: datagrams go wherever the client addresses them, and anything
+// sent to the socket comes back tagged with its source.
+func (s *Server) handleAssocProtocol(ctx context.Context, conn tnet.Conn, pr *peer, strm *protocol.UDPStrm) {
+	defer strm.Close()
+	flog.Infof("accepted UDP association %d from %s: %s", strm.SID(), userName(conn), strm.RemoteAddr())
+
+	uconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		pr.sendResult(strm.Strm, err, nil)
+		flog.Errorf("failed to open UDP socket for association %d: %v", strm.SID(), err)
+		return
+	}
+	pr.sendResult(strm.Strm, nil, uconn.LocalAddr())
+	defer func() {
+		uconn.Close()
+		flog.Debugf("closed UDP socket %s for association %d", uconn.LocalAddr(), strm.SID())
+	}()
+
+	a := protocol.NewAssocStrm(strm)
+	errChan := make(chan error, 2)
+	go func() { errChan <- s.assocOut(ctx, conn, a, uconn) }()
+	go func() { errChan <- assocIn(a, uconn) }()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			flog.Debugf("UDP association %d ended: %v", strm.SID(), err)
+		}
+	case <-ctx.Done():
+	}
+}
+
+// assocOut relays the client's datagrams. A destination not seen before is
+// checked and resolved in the background, so a slow lookup holds up only
+// the datagrams for it: the first is sent once the lookup is done, and
+// those that follow while it is running are dropped.
+func (s *Server) assocOut(ctx context.Context, conn tnet.Conn, a *protocol.AssocStrm, uconn *net.UDPConn) error {
+	var mu sync.Mutex
+	dests := make(map[string]*assocDest)
+	buf := make([]byte, buffer.UDPSize)
+	for {
+		n, addr, err := a.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		key := addr.String()
+		mu.Lock()
+		d, ok := dests[key]
+		if !ok || time.Now().After(d.expires) {
+			if len(dests) >= assocDestMax {
+				clear(dests)
+			}
+			d = &assocDest{expires: time.Now().Add(assocDestTTL)}
+			dests[key] = d
+			mu.Unlock()
+			go func(p []byte) {
+				dst := s.assocDest(ctx, conn, a, addr)
+				mu.Lock()
+				d.addr = dst
+				mu.Unlock()
+				if dst != nil {
+					assocSend(a, uconn, p, dst)
+				}
+			}(bytes.Clone(buf[:n]))
+			continue
+		}
+		dst := d.addr
+		mu.Unlock()
+		if dst != nil {
+			assocSend(a, uconn, buf[:n], dst)
+		}
+	}
+}
+
+func assocSend(a *protocol.AssocStrm, uconn *net.UDPConn, p []byte, dst *net.UDPAddr) {
+	if _, err := uconn.WriteToUDP(p, dst); err != nil {
+		flog.Debugf("UDP association %d failed to send to %s: %v", a.SID(), dst, err)
+	}
+}
+
+// assocDest checks addr against the egress rules and resolves it, giving
+// up after assocLookupTimeout. It returns nil if datagrams for addr are to
+// be dropped.
+func (s *Server) assocDest(ctx context.Context, conn tnet.Conn, a *protocol.AssocStrm, addr *tnet.Addr) *net.UDPAddr {
+	ctx, cancel := context.WithTimeout(ctx, assocLookupTimeout)
+	defer cancel()
+	dst, err := s.egress(ctx, conn, "udp", addr)
+	var udpAddr *net.UDPAddr
+	if err == nil {
+		udpAddr, err = resolveUDP(ctx, dst)
+	}
+	if err != nil {
+		if _, ok := err.(*aclError); ok {
+			flog.Warnf("UDP association %d from %s to %s %v", a.SID(), userName(conn), addr.String(), err)
+		} else {
+			flog.Errorf("failed to resolve %s for UDP association %d: %v", addr.String(), a.SID(), err)
+		}
+	}
+	return udpAddr
+}
+
+// resolveUDP is net.ResolveUDPAddr bounded by ctx.
+func resolveUDP(ctx context.Context, hostport string) (*net.UDPAddr, error) {
+	if ap, err := netip.ParseAddrPort(hostport); err == nil {
+		return net.UDPAddrFromAddrPort(ap), nil
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	// Prefer IPv4, as net.ResolveUDPAddr does.
+	ip := ips[0]
+	for _, a := range ips {
+		if a.Unmap().Is4() {
+			ip = a
+			break
+		}
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(p))), nil
+}
+
+// assocIn relays what arrives on uconn to the client. A datagram that cannot
+// be sent is dropped like any other lost datagram; if the stream itself has
+// failed, assocOut ends the association, which closes uconn.
+func assocIn(a *protocol.AssocStrm, uconn *net.UDPConn) error {
+	buf := make([]byte, buffer.UDPSize)
+	for {
+		n, from, err := uconn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return err
+		}
+		addr := &tnet.Addr{Host: from.Addr().Unmap().String(), Port: int(from.Port())}
+		if err := a.WriteTo(buf[:n], addr); errors.Is(err, protocol.ErrDatagramSize) {
+			flog.Errorf("UDP association %d dropped a datagram from %s: %v", a.SID(), addr, err)
+		} else if err != nil {
+			flog.Debugf("UDP association %d dropped a datagram from %s: %v", a.SID(), addr, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+const authTimeout = 10 * time.Second
+
+// authenticate runs the credential exchange on the first stream of conn:
+// the client names a user along with a challenge of its own, answers a
+// random challenge with that user's key and, once accepted, is sent its name
+// back with the server's answer to its challenge.
+func (s *Server) authenticate(conn tnet.Conn) (*tnet.UserConn, []byte, error) {
+	timer := time.AfterFunc(authTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	strm, err := conn.AcceptStrm()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer strm.Close()
+
+	var p protocol.Proto
+	if err := p.Read(strm); err != nil {
+		return nil, nil, err
+	}
+	if p.Type != protocol.PAUTH {
+		return nil, nil, fmt.Errorf("expected credentials, got message type %d", p.Type)
+	}
+	name, clientChallenge := p.User, p.Auth
+
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	c := protocol.Proto{Type: protocol.PAUTH, Auth: challenge}
+	if err := c.Write(strm); err != nil {
+		return nil, nil, err
+	}
+	if err := p.Read(strm); err != nil {
+		return nil, nil, err
+	}
+
+	u, ok := s.user(name)
+	if p.Type != protocol.PAUTH || p.User != name || !ok || !hmac.Equal(p.Auth, protocol.AuthMAC(u.Secret, challenge)) {
+		return nil, nil, fmt.Errorf("bad credentials for user '%s'", name)
+	}
+	ack := protocol.Proto{Type: protocol.PAUTH, User: name, Auth: protocol.ServerAuthMAC(u.Secret, challenge, clientChallenge)}
+	if err := ack.Write(strm); err != nil {
+		return nil, nil, err
+	}
+	if !timer.Stop() {
+		return nil, nil, errors.New("authentication timed out")
+	}
+	return &tnet.UserConn{Conn: conn, User: name}, u.Secret, nil
+}
+
+func (s *Server) user(name string) (conf.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	return u, ok
+}
+
+func (s *Server) requireAuth() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users) > 0
+}
+
+// track records conn until untrack is called, so a later SetUsers or
+// Drain can reach it.
+func (s *Server) track(conn tnet.Conn, pr *peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = pr
+}
+
+func (s *Server) untrack(conn tnet.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// SetUsers replaces the accepted credentials. Connections whose user was
+// removed or given a new key are told so and closed; an empty list lets
+// anyone holding the transport key connect.
+func (s *Server) SetUsers(users []conf.User) {
+	m := make(map[string]conf.User, len(users))
+	for _, u := range users {
+		m[u.Name] = u
+	}
+
+	s.mu.Lock()
+	s.users = m
+	s.setLimits(users)
+	revoked := make(map[tnet.Conn]*peer)
+	if len(m) > 0 {
+		for conn, pr := range s.conns {
+			if u, ok := m[tnet.User(conn)]; !ok || !bytes.Equal(u.Secret, pr.secret) {
+				revoked[conn] = pr
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if ul, ok := s.listener.(tnet.UserListener); ok {
+		ul.SetUsers(users)
+	}
+	flog.Infof("loaded %d users", len(m))
+	for conn, pr := range revoked {
+		flog.Infof("closing connection from %s: user %s is no longer accepted", conn.RemoteAddr(), userName(conn))
+		if pr.notify(protocol.NREVOKED, 0) {
+			// Give the notice a moment to reach the client.
+			time.AfterFunc(noticeGrace, func() { conn.Close() })
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+func userName(conn tnet.Conn) string {
+	if u := tnet.User(conn); u != "" {
+		return u
+	}
+	return "anonymous"
+}
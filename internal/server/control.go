@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"io"
+
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// handleCtrl serves the control stream a client opens once per connection:
+// it answers keepalives and acknowledges TCPF updates, while the server
+// sends notices down the same stream.
+func (s *Server) handleCtrl(conn tnet.Conn, strm tnet.Strm, pr *peer) {
+	if !pr.has(protocol.FCONTROL) {
+		flog.Errorf("control stream %d opened by %s without negotiating it", strm.SID(), conn.RemoteAddr())
+		return
+	}
+	pr.setCtrl(strm)
+	defer pr.setCtrl(nil)
+	flog.Debugf("control stream %d opened by %s", strm.SID(), conn.RemoteAddr())
+
+	var p protocol.Proto
+	for {
+		if err := p.Read(strm); err != nil {
+			if !errors.Is(err, io.EOF) {
+				flog.Debugf("control stream %d from %s closed: %v", strm.SID(), conn.RemoteAddr(), err)
+			}
+			return
+		}
+		switch p.Type {
+		case protocol.PPING:
+			pr.send(&protocol.Proto{Type: protocol.PPONG})
+		case protocol.PTCPF:
+			s.handleTCPF(strm, &p)
+			pr.send(&protocol.Proto{Type: protocol.PRSLT, Code: protocol.RSUCCESS})
+		default:
+			flog.Errorf("unexpected message type %d on control stream %d", p.Type, strm.SID())
+			return
+		}
+	}
+}
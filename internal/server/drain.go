@@ -0,0 +1,46 @@
+package server
+
+import (
+	"time"
+
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+)
+
+// Drain sends GOAWAY to every client, so that they open new streams
+// elsewhere, and waits up to timeout for their connections to close. New
+// connections are refused from then on.
+func (s *Server) Drain(timeout time.Duration) {
+	s.mu.Lock()
+	s.draining = true
+	peers := make([]*peer, 0, len(s.conns))
+	for _, pr := range s.conns {
+		peers = append(peers, pr)
+	}
+	s.mu.Unlock()
+
+	notified := 0
+	for _, pr := range peers {
+		if pr.notify(protocol.NGOAWAY, timeout) {
+			notified++
+		}
+	}
+	flog.Infof("draining %d connections (%d notified), waiting up to %s", len(peers), notified, timeout)
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
@@ -8,7 +8,7 @@ import (
 	"paqet/internal/tnet"
 )
 
-func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
+func (s *Server) handleConn(ctx context.Context, conn tnet.Conn, pr *peer) {
 	for {
 		strm, err := conn.AcceptStrm()
 		if err != nil {
@@ -17,13 +17,13 @@ func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
 		}
 		go func() {
 			defer strm.Close()
-			s.handleStrm(ctx, strm)
+			s.handleStrm(ctx, conn, pr, strm)
 			flog.Debugf("stream %d from %s closed", strm.SID(), strm.RemoteAddr())
 		}()
 	}
 }
 
-func (s *Server) handleStrm(ctx context.Context, strm tnet.Strm) {
+func (s *Server) handleStrm(ctx context.Context, conn tnet.Conn, pr *peer, strm tnet.Strm) {
 	var p protocol.Proto
 	err := p.Read(strm)
 	if err != nil {
@@ -31,15 +31,43 @@ func (s *Server) handleStrm(ctx context.Context, strm tnet.Strm) {
 		return
 	}
 
+	switch p.Type {
+	case protocol.PTCP, protocol.PUDP, protocol.PDGRM, protocol.PASOC:
+		if !s.allow(conn, pr) {
+			flog.Debugf("refused stream %d from %s: rate limited", strm.SID(), userName(conn))
+			return
+		}
+	}
+
 	switch p.Type {
 	case protocol.PPING:
-		s.handlePing(strm)
+		s.handlePing(strm, pr)
+	case protocol.PHELO:
+		s.handleHello(conn, strm, &p, pr)
+	case protocol.PCTRL:
+		s.handleCtrl(conn, strm, pr)
 	case protocol.PTCPF:
 		s.handleTCPF(strm, &p)
 	case protocol.PTCP:
-		s.handleTCPProtocol(ctx, strm, &p)
+		s.handleTCPProtocol(ctx, conn, pr, strm, &p, p.Reply)
 	case protocol.PUDP:
-		s.handleUDPProtocol(ctx, strm, &p)
+		ustrm := protocol.NewRawUDPStrm(strm)
+		if pr.has(protocol.FFRAMING) {
+			ustrm = protocol.NewUDPStrm(strm)
+		}
+		s.handleUDPProtocol(ctx, conn, pr, ustrm, &p)
+	case protocol.PDGRM:
+		if pr.flows == nil || !pr.has(protocol.FDATAGRAM) {
+			flog.Errorf("datagram stream %d requested on %s, which cannot carry datagrams", strm.SID(), conn.RemoteAddr())
+			return
+		}
+		s.handleUDPProtocol(ctx, conn, pr, protocol.NewFlowStrm(strm, pr.flows), &p)
+	case protocol.PASOC:
+		ustrm := protocol.NewUDPStrm(strm)
+		if pr.flows != nil && pr.has(protocol.FDATAGRAM) {
+			ustrm = protocol.NewFlowStrm(strm, pr.flows)
+		}
+		s.handleAssocProtocol(ctx, conn, pr, ustrm)
 	default:
 		flog.Errorf("unknown protocol type %d on stream %d", p.Type, strm.SID())
 	}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// handleHello answers a client's PHELO. The version and features agreed
+// on are recorded before the answer is sent, as the client waits for it
+// before opening other streams. Clients that never send one get the base
+// version and no features.
+func (s *Server) handleHello(conn tnet.Conn, strm tnet.Strm, p *protocol.Proto, pr *peer) {
+	local := protocol.NewHello()
+	ver, features, err := protocol.Negotiate(&local, p)
+	if err == nil {
+		pr.ver.Store(uint32(ver))
+		pr.features.Store(uint32(features))
+	}
+	if werr := local.Write(strm); werr != nil {
+		flog.Debugf("failed to answer hello on stream %d: %v", strm.SID(), werr)
+	}
+	if err != nil {
+		flog.Warnf("closing connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	flog.Debugf("using protocol version %d with %s, features: %s", ver, conn.RemoteAddr(), features)
+}
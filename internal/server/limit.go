@@ -0,0 +1,54 @@
+package server
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// setLimits rebuilds the stream limiters of users with a rate, keeping
+// those whose rate did not change. s.mu must be held.
+func (s *Server) setLimits(users []conf.User) {
+	limits := make(map[string]*rate.Limiter)
+	for _, u := range users {
+		if u.Rate == 0 {
+			continue
+		}
+		if l := s.limits[u.Name]; l != nil && l.Limit() == rate.Limit(u.Rate) {
+			limits[u.Name] = l
+			continue
+		}
+		limits[u.Name] = rate.NewLimiter(rate.Limit(u.Rate), u.Rate)
+	}
+	s.limits = limits
+}
+
+// allow takes a token for a new stream from the user on conn. When none
+// is left the client is told how long to hold off, unless it already was
+// and that time has not passed.
+func (s *Server) allow(conn tnet.Conn, pr *peer) bool {
+	s.mu.Lock()
+	l := s.limits[tnet.User(conn)]
+	s.mu.Unlock()
+	if l == nil || l.Allow() {
+		return true
+	}
+
+	wait := max(time.Duration((1-l.Tokens())/float64(l.Limit())*float64(time.Second)), time.Millisecond)
+	pr.mu.Lock()
+	notify := time.Now().After(pr.limited)
+	if notify {
+		pr.limited = time.Now().Add(wait)
+	}
+	pr.mu.Unlock()
+	if notify {
+		flog.Warnf("user %s on %s exceeded %v streams per second", userName(conn), conn.RemoteAddr(), l.Limit())
+		pr.notify(protocol.NRATELIMIT, wait)
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// noticeGrace is how long a connection is kept open after a notice that
+// ends it, so the notice is delivered first.
+const noticeGrace = 500 * time.Millisecond
+
+// peer is what the server knows of the client on one connection.
+type peer struct {
+	secret   []byte
+	flows    *protocol.Flows
+	features atomic.Uint32
+	// ver is the protocol version agreed on, zero until then.
+	ver atomic.Uint32
+
+	mu      sync.Mutex
+	ctrl    tnet.Strm
+	limited time.Time
+}
+
+func (p *peer) has(f protocol.Features) bool {
+	return protocol.Features(p.features.Load()).Has(f)
+}
+
+// version is the protocol version the server writes with; before one is
+// agreed on it is zero, which writes the base version.
+func (p *peer) version() byte {
+	return byte(p.ver.Load())
+}
+
+// send writes m on the control stream, reporting whether the client has
+// one to receive it.
+func (p *peer) send(m *protocol.Proto) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.Ver = p.version()
+	return p.ctrl != nil && m.Write(p.ctrl) == nil
+}
+
+func (p *peer) notify(code byte, delay time.Duration) bool {
+	return p.send(&protocol.Proto{Type: protocol.PNOTE, Code: code, Delay: delay})
+}
+
+func (p *peer) setCtrl(strm tnet.Strm) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ctrl = strm
+}
@@ -6,8 +6,8 @@ import (
 	"paqet/internal/tnet"
 )
 
-func (s *Server) handlePing(strm tnet.Strm) {
-	p := protocol.Proto{Type: protocol.PPONG}
+func (s *Server) handlePing(strm tnet.Strm, pr *peer) {
+	p := protocol.Proto{Type: protocol.PPONG, Ver: pr.version()}
 	if err := p.Write(strm); err != nil {
 		flog.Errorf("failed to send pong on stream %d: %v", strm.SID(), err)
 	}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// sendResult tells the client how its dial on strm ended: err is nil on
+// success, when bound is the local address of the new connection.
+func (p *peer) sendResult(strm tnet.Strm, err error, bound net.Addr) {
+	m := protocol.Proto{Type: protocol.PRSLT, Code: resultCode(err), Ver: p.version()}
+	if err == nil {
+		switch a := bound.(type) {
+		case *net.TCPAddr:
+			m.Addr = &tnet.Addr{Host: a.IP.String(), Port: a.Port}
+		case *net.UDPAddr:
+			m.Addr = &tnet.Addr{Host: a.IP.String(), Port: a.Port}
+		}
+	}
+	if err := m.Write(strm); err != nil {
+		flog.Debugf("failed to send dial result on stream %d: %v", strm.SID(), err)
+	}
+}
+
+func resultCode(err error) byte {
+	var dnsErr *net.DNSError
+	var aclErr *aclError
+	switch {
+	case err == nil:
+		return protocol.RSUCCESS
+	case errors.As(err, &aclErr):
+		return protocol.RDENIED
+	case errors.As(err, &dnsErr):
+		return protocol.RDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return protocol.RREFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return protocol.RNETUNREACH
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return protocol.RHOSTUNREACH
+	case errors.Is(err, os.ErrDeadlineExceeded), isTimeout(err):
+		return protocol.RTIMEOUT
+	}
+	return protocol.RFAILURE
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
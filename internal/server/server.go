@@ -3,30 +3,46 @@ package server
 import (
 	"context"
 	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
 
 	"paqet/internal/conf"
 	"paqet/internal/flog"
+	"paqet/internal/protocol"
 	"paqet/internal/tnet"
-	"paqet/internal/tnet/kcp"
+	"paqet/internal/tnet/transport"
 )
 
 type Server struct {
 	cfg      *conf.Conf
 	listener tnet.Listener
+
+	mu       sync.Mutex
+	users    map[string]conf.User
+	limits   map[string]*rate.Limiter
+	acl      []conf.Rule
+	conns    map[tnet.Conn]*peer
+	draining bool
 }
 
 func New(cfg *conf.Conf) (*Server, error) {
-	s := &Server{cfg: cfg}
+	s := &Server{cfg: cfg, conns: make(map[tnet.Conn]*peer)}
+	s.SetUsers(cfg.Users)
+	s.SetACL(cfg.ACL)
 	return s, nil
 }
 
 func (s *Server) Start(ctx context.Context) error {
-	listener, err := kcp.Listen(s.cfg.Transport.KCP, s.cfg.Network)
+	listener, err := transport.Listen(s.cfg)
 	if err != nil {
-		return fmt.Errorf("could not start KCP listener: %w", err)
+		return fmt.Errorf("could not start %s listener: %w", s.cfg.Transport.Protocol, err)
 	}
 	s.listener = listener
-	flog.Infof("server listening for packets on :%d", s.cfg.Listen.Addr.Port)
+	if ul, ok := listener.(tnet.UserListener); ok {
+		ul.SetUsers(s.cfg.Users)
+	}
+	flog.Infof("server listening for packets on :%d (%s)", s.cfg.Listen.Addr.Port, s.cfg.Network.Describe())
 
 	go s.listen(ctx, listener)
 	context.AfterFunc(ctx, func() { listener.Close() })
@@ -50,7 +66,27 @@ func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
 		go func() {
 			defer conn.Close()
 			defer s.listener.DeleteClientTCPF(conn.RemoteAddr())
-			s.handleConn(ctx, conn)
+			if s.isDraining() {
+				flog.Infof("refusing connection from %s: server is shutting down", conn.RemoteAddr())
+				return
+			}
+
+			pr := &peer{}
+			if dc, ok := conn.(tnet.DatagramConn); ok {
+				pr.flows = protocol.NewFlows(dc)
+			}
+			if s.requireAuth() {
+				uc, secret, err := s.authenticate(conn)
+				if err != nil {
+					flog.Warnf("rejected connection from %s: %v", conn.RemoteAddr(), err)
+					return
+				}
+				conn, pr.secret = uc, secret
+				flog.Infof("connection from %s authenticated as %s", conn.RemoteAddr(), uc.User)
+			}
+			s.track(conn, pr)
+			defer s.untrack(conn)
+			s.handleConn(ctx, conn, pr)
 		}()
 	}
 }
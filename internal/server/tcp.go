@@ -11,18 +11,38 @@ import (
 	"paqet/internal/tnet"
 )
 
-func (s *Server) handleTCPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) {
-	flog.Infof("accepted TCP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
-	s.handleTCP(ctx, strm, p.Addr.String())
+// handleTCPProtocol relays strm to the requested address, reporting how
+// the dial went if reply is set.
+func (s *Server) handleTCPProtocol(ctx context.Context, conn tnet.Conn, pr *peer, strm tnet.Strm, p *protocol.Proto, reply bool) {
+	flog.Infof("accepted TCP stream %d from %s: %s -> %s", strm.SID(), userName(conn), strm.RemoteAddr(), p.Addr.String())
+	addr, err := s.egress(ctx, conn, "tcp", p.Addr)
+	if err != nil {
+		if reply {
+			pr.sendResult(strm, err, nil)
+		}
+		if _, ok := err.(*aclError); ok {
+			flog.Warnf("TCP stream %d from %s to %s %v", strm.SID(), userName(conn), p.Addr.String(), err)
+		} else {
+			flog.Errorf("failed to resolve %s for TCP stream %d: %v", p.Addr.String(), strm.SID(), err)
+		}
+		return
+	}
+	s.handleTCP(ctx, pr, strm, addr, reply)
 }
 
-func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) {
+func (s *Server) handleTCP(ctx context.Context, pr *peer, strm tnet.Strm, addr string, reply bool) {
 	dialer := &net.Dialer{Timeout: 8 * time.Second}
 	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
+		if reply {
+			pr.sendResult(strm, err, nil)
+		}
 		flog.Errorf("failed to establish TCP connection to %s for stream %d: %v", addr, strm.SID(), err)
 		return
 	}
+	if reply {
+		pr.sendResult(strm, nil, conn.LocalAddr())
+	}
 	defer func() {
 		conn.Close()
 		flog.Debugf("closed TCP connection %s for stream %d", addr, strm.SID())
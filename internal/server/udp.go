@@ -11,18 +11,41 @@ import (
 	"paqet/internal/tnet"
 )
 
-func (s *Server) handleUDPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) {
-	flog.Infof("accepted UDP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
-	s.handleUDP(ctx, strm, p.Addr.String())
+// handleUDPProtocol relays datagrams between strm and addr. A PDGRM client
+// waits for the dial result before sending, as it falls back to PUDP on a
+// server that does not answer.
+func (s *Server) handleUDPProtocol(ctx context.Context, conn tnet.Conn, pr *peer, strm *protocol.UDPStrm, p *protocol.Proto) {
+	defer strm.Close()
+	reply := p.Type == protocol.PDGRM
+	flog.Infof("accepted UDP stream %d from %s: %s -> %s", strm.SID(), userName(conn), strm.RemoteAddr(), p.Addr.String())
+	addr, err := s.egress(ctx, conn, "udp", p.Addr)
+	if err != nil {
+		if _, ok := err.(*aclError); ok {
+			flog.Warnf("UDP stream %d from %s to %s %v", strm.SID(), userName(conn), p.Addr.String(), err)
+		} else {
+			flog.Errorf("failed to resolve %s for UDP stream %d: %v", p.Addr.String(), strm.SID(), err)
+		}
+		if reply {
+			pr.sendResult(strm.Strm, err, nil)
+		}
+		return
+	}
+	s.handleUDP(ctx, pr, strm, addr, reply)
 }
 
-func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, addr string) {
+func (s *Server) handleUDP(ctx context.Context, pr *peer, strm *protocol.UDPStrm, addr string, reply bool) {
 	dialer := &net.Dialer{Timeout: 8 * time.Second}
 	conn, err := dialer.DialContext(ctx, "udp", addr)
 	if err != nil {
 		flog.Errorf("failed to establish UDP connection to %s for stream %d: %v", addr, strm.SID(), err)
+		if reply {
+			pr.sendResult(strm.Strm, err, nil)
+		}
 		return
 	}
+	if reply {
+		pr.sendResult(strm.Strm, nil, conn.LocalAddr())
+	}
 	defer func() {
 		conn.Close()
 		flog.Debugf("closed UDP connection %s for stream %d", addr, strm.SID())
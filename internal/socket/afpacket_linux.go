@@ -0,0 +1,350 @@
+//go:build linux
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/afpacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+)
+
+const (
+	txFrameSize   = 1 << 11
+	txFrameCount  = 1 << 9
+	txHdrLen      = unix.SizeofTpacket2Hdr
+	rxMaxBlock    = 1 << 20
+	statsInterval = 10 * time.Second
+)
+
+func init() {
+	Register("afpacket", afpacketBackend{})
+}
+
+// afpacketBackend captures through a TPACKET_V3 mmap ring and injects through
+// a TPACKET_V2 TX ring, without going through libpcap.
+type afpacketBackend struct{}
+
+func (afpacketBackend) OpenSend(cfg *conf.Network) (Handle, error) {
+	return newTxRing(cfg.Interface)
+}
+
+// afpacketLinkType reports how frames look on a packet socket bound to iface,
+// going by its ARPHRD type: Ethernet and loopback devices carry an Ethernet
+// header, while tun, WireGuard and PPP links carry bare IP.
+func afpacketLinkType(iface *net.Interface) layers.LinkType {
+	hw, err := arphrd(iface.Name)
+	if err != nil {
+		flog.Debugf("failed to read the hardware type of %s, guessing from its flags: %v", iface.Name, err)
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) > 0 {
+			return layers.LinkTypeEthernet
+		}
+		return layers.LinkTypeRaw
+	}
+	switch hw {
+	case unix.ARPHRD_ETHER, unix.ARPHRD_LOOPBACK:
+		return layers.LinkTypeEthernet
+	}
+	return layers.LinkTypeRaw
+}
+
+func arphrd(name string) (uint16, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFHWADDR, ifr); err != nil {
+		return 0, err
+	}
+	// The hardware address comes back as a sockaddr whose family is the
+	// ARPHRD type.
+	return ifr.Uint16(), nil
+}
+
+func (afpacketBackend) OpenRecv(cfg *conf.Network, filter string) (Handle, error) {
+	// Fanout rings share the configured buffer.
+	size := cfg.PCAP.Sockbuf / max(cfg.PCAP.Fanout, 1)
+	page := os.Getpagesize()
+	block := rxMaxBlock
+	for block > page && block*4 > size {
+		block >>= 1
+	}
+	blocks := max(size/block, 1)
+
+	tp, err := afpacket.NewTPacket(
+		afpacket.OptInterface(cfg.Interface.Name),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptFrameSize(page),
+		afpacket.OptBlockSize(block),
+		afpacket.OptNumBlocks(blocks),
+		afpacket.OptBlockTimeout(time.Millisecond),
+		afpacket.OptPollTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AF_PACKET ring on %s: %v", cfg.Interface.Name, err)
+	}
+
+	lt := afpacketLinkType(cfg.Interface)
+	prog, err := inboundBPF(lt, filter)
+	if err != nil {
+		tp.Close()
+		return nil, err
+	}
+	if err := tp.SetBPF(prog); err != nil {
+		tp.Close()
+		return nil, fmt.Errorf("failed to attach BPF filter: %v", err)
+	}
+	if cfg.PCAP.Fanout > 1 {
+		// Hash fanout keeps every flow on one ring, so per-peer order holds.
+		if err := tp.SetFanout(afpacket.FanoutHash, uint16(cfg.Port)); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("failed to join fanout group %d: %v", cfg.Port, err)
+		}
+	}
+
+	h := &rxRing{tp: tp, iface: cfg.Interface.Name, lt: lt, done: make(chan struct{})}
+	go h.reportDrops()
+	return h, nil
+}
+
+// inboundBPF compiles filter for the kernel and prefixes it with a check that
+// drops outgoing frames, since AF_PACKET sockets see both directions.
+func inboundBPF(lt layers.LinkType, filter string) ([]bpf.RawInstruction, error) {
+	insns, err := pcap.CompileBPFFilter(lt, 65536, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile BPF filter %q: %v", filter, err)
+	}
+	prog, err := bpf.Assemble([]bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtType},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.PACKET_OUTGOING, SkipFalse: 1},
+		bpf.RetConstant{Val: 0},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, in := range insns {
+		prog = append(prog, bpf.RawInstruction{Op: in.Code, Jt: in.Jt, Jf: in.Jf, K: in.K})
+	}
+	return prog, nil
+}
+
+type rxRing struct {
+	tp     *afpacket.TPacket
+	iface  string
+	lt     layers.LinkType
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	drops  uint
+}
+
+func (h *rxRing) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data, ci, err := h.tp.ZeroCopyReadPacketData()
+	if errors.Is(err, afpacket.ErrTimeout) {
+		err = pcap.NextErrorTimeoutExpired
+	}
+	return data, ci, err
+}
+
+func (h *rxRing) WritePacketData(data []byte) error {
+	return h.tp.WritePacketData(data)
+}
+
+func (h *rxRing) LinkType() layers.LinkType {
+	return h.lt
+}
+
+// Drops returns the number of frames the kernel dropped because the ring
+// was full.
+func (h *rxRing) Drops() uint {
+	_, stats, err := h.tp.SocketStats()
+	if err != nil {
+		return 0
+	}
+	return stats.Drops()
+}
+
+// reportDrops logs new kernel drops every statsInterval. It reads the
+// stats under mu, as Close may be tearing the ring down.
+func (h *rxRing) reportDrops() {
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			h.mu.Lock()
+			if h.closed {
+				h.mu.Unlock()
+				return
+			}
+			d := h.Drops()
+			h.mu.Unlock()
+			if d > h.drops {
+				flog.Warnf("afpacket: kernel dropped %d frames on %s (%d total), consider a larger pcap.sockbuf", d-h.drops, h.iface, d)
+				h.drops = d
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *rxRing) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.done)
+	if d := h.Drops(); d > 0 {
+		flog.Infof("afpacket: kernel dropped %d frames on %s", d, h.iface)
+	}
+	h.tp.Close()
+}
+
+// txRing queues frames in a PACKET_TX_RING and lets the kernel transmit
+// everything queued since the last kick with a single sendto.
+type txRing struct {
+	fd     int
+	lt     layers.LinkType
+	ring   []byte
+	next   int
+	mu     sync.Mutex
+	kick   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+	closed bool
+}
+
+func newTxRing(iface *net.Interface) (*txRing, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AF_PACKET socket: %v", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V2); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to select TPACKET_V2: %v", err)
+	}
+	req := unix.TpacketReq{
+		Block_size: txFrameSize * 32,
+		Block_nr:   txFrameCount / 32,
+		Frame_size: txFrameSize,
+		Frame_nr:   txFrameCount,
+	}
+	if err := unix.SetsockoptTpacketReq(fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &req); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set up TX ring: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind AF_PACKET socket to %s: %v", iface.Name, err)
+	}
+	ring, err := unix.Mmap(fd, 0, txFrameSize*txFrameCount, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to map TX ring: %v", err)
+	}
+
+	h := &txRing{fd: fd, lt: afpacketLinkType(iface), ring: ring, kick: make(chan struct{}, 1), done: make(chan struct{})}
+	h.wg.Add(1)
+	go h.flush()
+	return h, nil
+}
+
+func (h *txRing) frame(i int) (*unix.Tpacket2Hdr, []byte) {
+	f := h.ring[i*txFrameSize : (i+1)*txFrameSize]
+	return (*unix.Tpacket2Hdr)(unsafe.Pointer(&f[0])), f[txHdrLen:]
+}
+
+func (h *txRing) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (h *txRing) LinkType() layers.LinkType {
+	return h.lt
+}
+
+func (h *txRing) WritePacketData(data []byte) error {
+	if len(data) > txFrameSize-txHdrLen {
+		return fmt.Errorf("afpacket: frame of %d bytes exceeds TX slot", len(data))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return net.ErrClosed
+	}
+	hdr, buf := h.frame(h.next)
+	if atomic.LoadUint32(&hdr.Status) != unix.TP_STATUS_AVAILABLE {
+		// The ring is full; wait for the kernel to drain it.
+		if err := unix.Sendto(h.fd, nil, 0, nil); err != nil {
+			return err
+		}
+		if atomic.LoadUint32(&hdr.Status) != unix.TP_STATUS_AVAILABLE {
+			return unix.ENOBUFS
+		}
+	}
+	copy(buf, data)
+	hdr.Len = uint32(len(data))
+	atomic.StoreUint32(&hdr.Status, unix.TP_STATUS_SEND_REQUEST)
+	h.next = (h.next + 1) % txFrameCount
+
+	select {
+	case h.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (h *txRing) flush() {
+	defer h.wg.Done()
+	for {
+		select {
+		case <-h.kick:
+			unix.Sendto(h.fd, nil, unix.MSG_DONTWAIT, nil)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *txRing) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.done)
+	// flush may still be kicking the ring; the fd must outlive it.
+	h.wg.Wait()
+	unix.Sendto(h.fd, nil, 0, nil)
+	unix.Munmap(h.ring)
+	unix.Close(h.fd)
+}
@@ -0,0 +1,49 @@
+package socket
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+
+	"paqet/internal/conf"
+)
+
+// Handle moves raw link-layer frames on one interface. *pcap.Handle satisfies
+// it, and other backends follow its contract: a read that times out reports
+// pcap.NextErrorTimeoutExpired and a read on a closed handle reports io.EOF.
+type Handle interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	LinkType() layers.LinkType
+	Close()
+}
+
+// Backend opens the handles a PacketConn sends and receives on. Receive
+// handles only deliver inbound frames matching the BPF filter expression.
+type Backend interface {
+	OpenSend(cfg *conf.Network) (Handle, error)
+	OpenRecv(cfg *conf.Network, filter string) (Handle, error)
+}
+
+var (
+	backends   = map[string]Backend{"pcap": pcapBackend{}}
+	backendsMu sync.RWMutex
+)
+
+// Register makes a backend selectable by name through network.pcap.backend.
+func Register(name string, b Backend) {
+	backendsMu.Lock()
+	backends[name] = b
+	backendsMu.Unlock()
+}
+
+func backend(name string) (Backend, error) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	if b, ok := backends[name]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown packet backend %q", name)
+}
@@ -0,0 +1,24 @@
+package socket
+
+import (
+	"net"
+
+	"paqet/internal/conf"
+)
+
+// Carrier is the packet socket a transport runs over: a raw PacketConn, or a
+// UDPConn with transport.carrier udp.
+type Carrier interface {
+	net.PacketConn
+	Passive()
+	CloseFlow(addr net.Addr)
+	SetClientTCPF(addr net.Addr, f []conf.TCPF)
+	DeleteClientTCPF(addr net.Addr)
+}
+
+func NewCarrier(cfg *conf.Transport, netCfg *conf.Network) (Carrier, error) {
+	if cfg.Carrier == "udp" {
+		return NewUDP(netCfg)
+	}
+	return New(netCfg)
+}
@@ -0,0 +1,197 @@
+package socket
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+
+	"paqet/internal/conf"
+)
+
+// header is the prebuilt link, IP and TCP header of the non-SYN segments sent
+// to one peer. Fields that change per packet, TOS and TTL included, are left
+// zero, and the checksum sums cover everything else, so a segment only needs
+// its own fields added.
+type header struct {
+	b      []byte
+	ip     int
+	tcp    int
+	ts     int
+	ipv6   bool
+	mac    *net.HardwareAddr
+	ipSum  uint64
+	tcpSum uint64
+}
+
+// header returns the template for the flow, rebuilding it when the router
+// MAC changed since it was made.
+func (h *SendHandle) header(fl *flow, addr *net.UDPAddr) (*header, error) {
+	ipv6 := addr.IP.To4() == nil
+	var mac *net.HardwareAddr
+	if h.link == linkEthernet {
+		if ipv6 {
+			mac = h.srcIPv6RHWA.Load()
+		} else {
+			mac = h.srcIPv4RHWA.Load()
+		}
+	}
+	if hd := fl.hdr.Load(); hd != nil && hd.mac == mac {
+		return hd, nil
+	}
+
+	hd, err := h.buildHeader(addr, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	hd.mac = mac
+	fl.hdr.Store(hd)
+	return hd, nil
+}
+
+func (h *SendHandle) buildHeader(addr *net.UDPAddr, ipv6 bool) (*header, error) {
+	e := h.ePool.Get().(*encoder)
+	defer func() {
+		e.buf.Clear()
+		h.ePool.Put(e)
+	}()
+
+	e.tcp = layers.TCP{SrcPort: layers.TCPPort(h.srcPort), DstPort: layers.TCPPort(addr.Port)}
+	e.ts = [8]byte{}
+	e.tcp.Options = h.options(e, h.fp.Options)
+	ls := append(h.frame(e, addr.IP), &e.tcp)
+	if err := gopacket.SerializeLayers(e.buf, gopacket.SerializeOptions{FixLengths: true}, ls...); err != nil {
+		return nil, err
+	}
+
+	hd := &header{ip: h.link.headerLen(), ts: -1, ipv6: ipv6}
+	if h.link == linkEthernet {
+		// Ethernet pads short frames, so the offsets follow from the
+		// layers: the Ethernet header, its VLAN tags, then IP and TCP.
+		hd.ip = 14 + 4*(len(ls)-3)
+	}
+	hd.tcp = hd.ip + 20
+	if ipv6 {
+		hd.tcp = hd.ip + 40
+	}
+	b := slices.Clone(e.buf.Bytes()[:hd.tcp+int(e.tcp.DataOffset)*4])
+	hd.b = b
+	if ipv6 {
+		b[hd.ip], b[hd.ip+1], b[hd.ip+7] = 0x60, b[hd.ip+1]&0x0f, 0
+		binary.BigEndian.PutUint16(b[hd.ip+4:], 0)
+		hd.tcpSum = csumAdd(0, b[hd.ip+8:hd.ip+40])
+	} else {
+		b[hd.ip+1], b[hd.ip+8] = 0, 0
+		binary.BigEndian.PutUint16(b[hd.ip+2:], 0)
+		hd.ipSum = csumAdd(0, b[hd.ip:hd.tcp])
+		hd.tcpSum = csumAdd(0, b[hd.ip+12:hd.ip+20])
+	}
+	hd.tcpSum += uint64(layers.IPProtocolTCP)
+	hd.tcpSum = csumAdd(hd.tcpSum, b[hd.tcp:hd.tcp+4])
+	hd.tcpSum = csumAdd(hd.tcpSum, b[hd.tcp+16:])
+
+	for i := hd.tcp + 20; i < len(b); {
+		kind := layers.TCPOptionKind(b[i])
+		if kind == layers.TCPOptionKindEndList {
+			break
+		}
+		if kind == layers.TCPOptionKindNop {
+			i++
+			continue
+		}
+		if kind == layers.TCPOptionKindTimestamps {
+			hd.ts = i + 2
+		}
+		i += int(b[i+1])
+	}
+	return hd, nil
+}
+
+// writeHeader sends payload behind a copy of the template, filling in the
+// per-segment fields and checksums.
+func (h *SendHandle) writeHeader(hd *header, payload []byte, fl *flow, f conf.TCPF) error {
+	bp := h.bufs.Get().(*[]byte)
+	b := append(append((*bp)[:0], hd.b...), payload...)
+	*bp = b
+	defer h.bufs.Put(bp)
+
+	seq, ack, tsVal, tsEcr := fl.next(len(payload), false, f.FIN)
+	tcp := b[hd.tcp:]
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	if f.ACK {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	if f.NS {
+		tcp[12] |= 0x01
+	}
+	tcp[13] = tcpFlags(f)
+	binary.BigEndian.PutUint16(tcp[14:], h.window())
+	sum := hd.tcpSum + uint64(len(tcp))
+	sum = csumAdd(sum, tcp[4:16])
+	if hd.ts >= 0 {
+		binary.BigEndian.PutUint32(b[hd.ts:], tsVal)
+		binary.BigEndian.PutUint32(b[hd.ts+4:], tsEcr)
+		// Custom layouts may leave the value on an odd offset, where its
+		// bytes are the low halves of their words.
+		var w [10]byte
+		odd := (hd.ts - hd.tcp) & 1
+		copy(w[odd:], b[hd.ts:hd.ts+8])
+		sum = csumAdd(sum, w[:])
+	}
+	sum = csumAdd(sum, payload)
+	binary.BigEndian.PutUint16(tcp[16:], ^csumFold(sum))
+
+	tos, ttl := h.nextTOS(), h.nextTTL()
+	if hd.ipv6 {
+		b[hd.ip] |= tos >> 4
+		b[hd.ip+1] |= tos << 4
+		b[hd.ip+7] = ttl
+		binary.BigEndian.PutUint16(b[hd.ip+4:], uint16(len(tcp)))
+	} else {
+		n := uint16(len(b) - hd.ip)
+		id := h.nextIPID(fl)
+		b[hd.ip+1], b[hd.ip+8] = tos, ttl
+		binary.BigEndian.PutUint16(b[hd.ip+2:], n)
+		binary.BigEndian.PutUint16(b[hd.ip+4:], id)
+		sum := hd.ipSum + uint64(n) + uint64(id) + uint64(tos) + uint64(ttl)<<8
+		binary.BigEndian.PutUint16(b[hd.ip+10:], ^csumFold(sum))
+	}
+
+	return h.send(b)
+}
+
+func tcpFlags(f conf.TCPF) byte {
+	var b byte
+	for i, set := range [8]bool{f.FIN, f.SYN, f.RST, f.PSH, f.ACK, f.URG, f.ECE, f.CWR} {
+		if set {
+			b |= 1 << i
+		}
+	}
+	return b
+}
+
+// csumAdd adds b, as big-endian 16-bit words, to the one's complement sum s.
+// Adding 32-bit words at a time yields the same sum once folded.
+func csumAdd(s uint64, b []byte) uint64 {
+	for len(b) >= 4 {
+		s += uint64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		s += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint64(b[0]) << 8
+	}
+	return s
+}
+
+func csumFold(s uint64) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
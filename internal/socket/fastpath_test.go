@@ -0,0 +1,235 @@
+package socket
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+
+	"paqet/internal/conf"
+)
+
+type discard struct{}
+
+func (discard) OpenSend(cfg *conf.Network) (Handle, error)                { return discard{}, nil }
+func (discard) OpenRecv(cfg *conf.Network, filter string) (Handle, error) { return discard{}, nil }
+func (discard) WritePacketData(data []byte) error                         { return nil }
+func (discard) LinkType() layers.LinkType                                 { return layers.LinkTypeEthernet }
+func (discard) Close()                                                    {}
+
+func (discard) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, nil
+}
+
+// capture keeps a copy of the last frame sent through it.
+type capture struct {
+	discard
+	last []byte
+}
+
+func (c *capture) OpenSend(cfg *conf.Network) (Handle, error) { return c, nil }
+func (c *capture) WritePacketData(data []byte) error {
+	c.last = bytes.Clone(data)
+	return nil
+}
+
+var (
+	testMAC    = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	testRouter = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+)
+
+func testNetwork(opts []string, vlan conf.VLAN) *conf.Network {
+	wscale := 7
+	cfg := &conf.Network{Interface: &net.Interface{Name: "test0", HardwareAddr: testMAC}, Port: 40000, VLAN: vlan}
+	cfg.IPv4.Addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}
+	cfg.IPv4.Router = testRouter
+	cfg.IPv6.Addr = &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 40000}
+	cfg.IPv6.Router = testRouter
+	cfg.TCP.LF = []conf.TCPF{{PSH: true, ACK: true}}
+	cfg.TCP.Profile = conf.Fingerprint{
+		TTL: conf.Range{Min: 64, Max: 64}, IPID: "flow", SynWindow: 64240, Window: conf.Range{Min: 4096, Max: 4096}, WScale: &wscale, MSS: 1460,
+		SynOptions: []string{"mss", "sack_perm", "ts", "nop", "ws"}, Options: opts,
+	}
+	return cfg
+}
+
+func newTestHandle(tb testing.TB, cfg *conf.Network, b Backend) *SendHandle {
+	flows := newFlowTable()
+	tb.Cleanup(flows.close)
+	h, err := NewSendHandle(cfg, b, flows)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(h.Close)
+	return h
+}
+
+func benchHandle(b *testing.B) *SendHandle {
+	return newTestHandle(b, testNetwork([]string{"nop", "nop", "ts"}, conf.VLAN{}), discard{})
+}
+
+// reserialize decodes frame and serializes it again with gopacket computing
+// the lengths and checksums.
+func reserialize(t *testing.T, frame []byte) []byte {
+	t.Helper()
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	if el := p.ErrorLayer(); el != nil {
+		t.Fatalf("failed to decode frame: %v", el.Error())
+	}
+	var ls []gopacket.SerializableLayer
+	for _, l := range p.Layers() {
+		if tcp, ok := l.(*layers.TCP); ok {
+			if ip, ok := p.NetworkLayer().(*layers.IPv4); ok {
+				tcp.SetNetworkLayerForChecksum(ip)
+			} else {
+				tcp.SetNetworkLayerForChecksum(p.NetworkLayer().(*layers.IPv6))
+			}
+		}
+		sl, ok := l.(gopacket.SerializableLayer)
+		if !ok {
+			t.Fatalf("layer %s cannot be serialized", l.LayerType())
+		}
+		ls = append(ls, sl)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHeaderMatchesLayers(t *testing.T) {
+	tests := []struct {
+		name string
+		dst  net.IP
+		opts []string
+		vlan conf.VLAN
+	}{
+		{"ipv4", net.IPv4(10, 0, 0, 1), []string{"nop", "nop", "ts"}, conf.VLAN{}},
+		{"ipv4 no ts", net.IPv4(10, 0, 0, 1), nil, conf.VLAN{}},
+		{"ipv4 odd ts", net.IPv4(10, 0, 0, 1), []string{"nop", "ts"}, conf.VLAN{}},
+		{"ipv4 vlan", net.IPv4(10, 0, 0, 1), []string{"nop", "nop", "ts"}, conf.VLAN{ID: 100, Priority: 3}},
+		{"ipv4 qinq", net.IPv4(10, 0, 0, 1), []string{"nop", "ts"}, conf.VLAN{ID: 100, Outer: 200}},
+		{"ipv6", net.ParseIP("fd00::1"), []string{"nop", "nop", "ts"}, conf.VLAN{}},
+		{"ipv6 no ts", net.ParseIP("fd00::1"), nil, conf.VLAN{}},
+		{"ipv6 odd ts", net.ParseIP("fd00::1"), []string{"nop", "ts"}, conf.VLAN{}},
+		{"ipv6 vlan", net.ParseIP("fd00::1"), []string{"nop", "nop", "ts"}, conf.VLAN{ID: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &capture{}
+			h := newTestHandle(t, testNetwork(tt.opts, tt.vlan), c)
+			addr := &net.UDPAddr{IP: tt.dst, Port: 9999}
+			payload := []byte("some payload of odd length")
+			f := conf.TCPF{PSH: true, ACK: true}
+			fl := h.flows.get(addr.IP, uint16(addr.Port))
+
+			hd, err := h.header(fl, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (hd.ts >= 0) != slices.Contains(tt.opts, "ts") {
+				t.Fatalf("timestamp offset %d for options %v", hd.ts, tt.opts)
+			}
+			fl.seq, fl.ack, fl.ipid = 1000, 2000, 7
+			if err := h.writeHeader(hd, payload, fl, f); err != nil {
+				t.Fatal(err)
+			}
+			fast := c.last
+			if want := reserialize(t, fast); !bytes.Equal(fast, want) {
+				t.Fatalf("bad lengths or checksums:\n got %x\nwant %x", fast, want)
+			}
+
+			fl.seq, fl.ack, fl.ipid = 1000, 2000, 7
+			if err := h.writeLayers(payload, addr, fl, f); err != nil {
+				t.Fatal(err)
+			}
+			slow := c.last
+			// The timestamp is read from the clock, so it and the TCP
+			// checksum covering it may differ between the two.
+			for _, b := range [][]byte{fast, slow} {
+				b[hd.tcp+16], b[hd.tcp+17] = 0, 0
+				if hd.ts >= 0 {
+					copy(b[hd.ts:hd.ts+4], []byte{0, 0, 0, 0})
+				}
+			}
+			if !bytes.Equal(fast, slow) {
+				t.Fatalf("template differs from gopacket:\n got %x\nwant %x", fast, slow)
+			}
+		})
+	}
+}
+
+func TestHeaderRebuildsOnRouterChange(t *testing.T) {
+	c := &capture{}
+	h := newTestHandle(t, testNetwork([]string{"nop", "nop", "ts"}, conf.VLAN{}), c)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 9999}
+	fl := h.flows.get(addr.IP, uint16(addr.Port))
+
+	hd, err := h.header(fl, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := h.header(fl, addr); again != hd {
+		t.Fatal("template rebuilt without a router change")
+	}
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}
+	h.srcIPv4RHWA.Store(&mac)
+	rebuilt, err := h.header(fl, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt == hd {
+		t.Fatal("template kept after the router changed")
+	}
+	if err := h.writeHeader(rebuilt, []byte("x"), fl, conf.TCPF{ACK: true}); err != nil {
+		t.Fatal(err)
+	}
+	if dst := net.HardwareAddr(c.last[:6]); !bytes.Equal(dst, mac) {
+		t.Fatalf("frame sent to %s, want %s", dst, mac)
+	}
+	if want := reserialize(t, c.last); !bytes.Equal(c.last, want) {
+		t.Fatalf("bad lengths or checksums:\n got %x\nwant %x", c.last, want)
+	}
+}
+
+// BenchmarkBuildHeader sends segments from the per-flow header template.
+func BenchmarkBuildHeader(b *testing.B) {
+	h := benchHandle(b)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 9999}
+	payload := make([]byte, 1200)
+	f := conf.TCPF{PSH: true, ACK: true}
+	fl := h.flows.get(addr.IP, uint16(addr.Port))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		hd, err := h.header(fl, addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := h.writeHeader(hd, payload, fl, f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSerializeLayers sends the same segments through the full
+// gopacket.SerializeLayers path as a baseline.
+func BenchmarkSerializeLayers(b *testing.B) {
+	h := benchHandle(b)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 9999}
+	payload := make([]byte, 1200)
+	f := conf.TCPF{PSH: true, ACK: true}
+	fl := h.flows.get(addr.IP, uint16(addr.Port))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := h.writeLayers(payload, addr, fl, f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package socket
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/pkg/hash"
+)
+
+const (
+	flowIdle  = 5 * time.Minute
+	flowSweep = time.Minute
+)
+
+type flowState uint8
+
+const (
+	flowNew flowState = iota
+	flowSynSent
+	flowSynRcvd
+	flowEstablished
+	flowFinWait
+	flowClosed
+)
+
+// flow is the TCP state paqet pretends to have with one peer. Sequence
+// numbers advance by what is actually sent, the ack tracks the highest byte
+// seen from the peer, and timestamps echo the peer's clock.
+type flow struct {
+	mu       sync.Mutex
+	state    flowState
+	iss      uint32
+	synAt    time.Time
+	closed   chan struct{}
+	seq      uint32
+	ack      uint32
+	synced   bool
+	tsOff    uint32
+	tsRecent uint32
+	ipid     uint16
+	lastSeen time.Time
+	hdr      atomic.Pointer[header]
+}
+
+// next returns the header fields for a segment carrying n bytes and advances
+// the send sequence past it.
+func (f *flow) next(n int, syn, fin bool) (seq, ack, tsVal, tsEcr uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seq = f.seq
+	f.lastSeen = time.Now()
+	f.seq += uint32(n)
+	if syn {
+		f.seq++
+	}
+	if fin {
+		f.seq++
+	}
+	return seq, f.ack, f.tsOff + uint32(time.Now().UnixMilli()), f.tsRecent
+}
+
+func (f *flow) nextID() uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ipid++
+	return f.ipid
+}
+
+// observe records a segment received from the peer.
+func (f *flow) observe(seq uint32, n int, syn, fin bool, tsVal uint32, hasTS bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := seq + uint32(n)
+	if syn {
+		end++
+	}
+	if fin {
+		end++
+	}
+	// The first segment seen sets the ack whatever its sequence, as
+	// without a handshake the peer's numbers bear no relation to ours.
+	if syn || !f.synced || seqAfter(end, f.ack) {
+		f.ack = end
+		f.synced = true
+	}
+	if hasTS {
+		f.tsRecent = tsVal
+	}
+	f.lastSeen = time.Now()
+}
+
+// close marks the flow as torn down; f.mu must be held.
+func (f *flow) close() {
+	if f.state != flowClosed {
+		f.state = flowClosed
+		close(f.closed)
+	}
+}
+
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+type flowTable struct {
+	mu    sync.Mutex
+	flows map[uint64]*flow
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newFlowTable() *flowTable {
+	t := &flowTable{
+		flows: make(map[uint64]*flow),
+		done:  make(chan struct{}),
+	}
+	go t.sweep()
+	return t
+}
+
+func flowKey(ip net.IP, port uint16) uint64 {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return hash.IPAddr(ip, port)
+}
+
+func (t *flowTable) get(ip net.IP, port uint16) *flow {
+	k := flowKey(ip, port)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.flows[k]
+	if f == nil {
+		iss := rand.Uint32()
+		f = &flow{
+			iss:      iss,
+			closed:   make(chan struct{}),
+			seq:      iss,
+			ack:      rand.Uint32(),
+			tsOff:    rand.Uint32(),
+			ipid:     uint16(rand.Uint32()),
+			lastSeen: time.Now(),
+		}
+		t.flows[k] = f
+	}
+	return f
+}
+
+func (t *flowTable) delete(ip net.IP, port uint16) {
+	t.mu.Lock()
+	delete(t.flows, flowKey(ip, port))
+	t.mu.Unlock()
+}
+
+// sweep drops flows that have been silent for a while, such as peers that
+// never completed a session.
+func (t *flowTable) sweep() {
+	tk := time.NewTicker(flowSweep)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			t.mu.Lock()
+			for k, f := range t.flows {
+				f.mu.Lock()
+				idle := time.Since(f.lastSeen) > flowIdle
+				f.mu.Unlock()
+				if idle {
+					delete(t.flows, k)
+				}
+			}
+			t.mu.Unlock()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *flowTable) close() {
+	t.once.Do(func() { close(t.done) })
+}
@@ -5,11 +5,63 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
 
 	"paqet/internal/conf"
 )
 
+type pcapBackend struct{}
+
+func (pcapBackend) OpenSend(cfg *conf.Network) (Handle, error) {
+	handle, err := newHandle(cfg, 256*1024, 128, pcap.BlockForever)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pcap handle: %w", err)
+	}
+
+	// Cooked captures such as "any" cannot inject; hand the packets to the
+	// kernel to route instead.
+	if lt := handle.LinkType(); lt == layers.LinkTypeLinuxSLL || lt == layers.LinkTypeLinuxSLL2 {
+		handle.Close()
+		return openRawIP()
+	}
+
+	// SetDirection is not fully supported on Windows Npcap, so skip it
+	if runtime.GOOS != "windows" {
+		if err := handle.SetDirection(pcap.DirectionOut); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to set pcap direction out: %v", err)
+		}
+	}
+
+	if err := handle.SetBPFFilter("less 0"); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to set BPF filter: %w", err)
+	}
+	return handle, nil
+}
+
+func (pcapBackend) OpenRecv(cfg *conf.Network, filter string) (Handle, error) {
+	handle, err := newHandle(cfg, cfg.PCAP.Sockbuf, 65536, 100*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pcap handle: %w", err)
+	}
+
+	// SetDirection is not fully supported on Windows Npcap, so skip it
+	if runtime.GOOS != "windows" {
+		if err := handle.SetDirection(pcap.DirectionIn); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to set pcap direction in: %v", err)
+		}
+	}
+
+	if err := handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to set BPF filter: %w", err)
+	}
+	return handle, nil
+}
+
 func newHandle(cfg *conf.Network, sockbuf int, snapLen int, timeout time.Duration) (*pcap.Handle, error) {
 	// On Windows, use the GUID field to construct the NPF device name
 	// On other platforms, use the interface name directly
@@ -0,0 +1,123 @@
+package socket
+
+import (
+	"net"
+	"time"
+
+	"paqet/internal/conf"
+)
+
+const (
+	synRetry = time.Second
+	finWait  = time.Second
+)
+
+var (
+	flagSYN    = conf.TCPF{SYN: true}
+	flagSYNACK = conf.TCPF{SYN: true, ACK: true}
+	flagACK    = conf.TCPF{ACK: true}
+	flagFINACK = conf.TCPF{FIN: true, ACK: true}
+)
+
+// Passive makes c answer handshakes without ever initiating one, as a
+// listener does.
+func (c *PacketConn) Passive() {
+	c.passive = true
+}
+
+// admit reports whether payload may be sent to addr. Until the handshake
+// has completed it sends, and periodically retries, the SYN instead.
+func (c *PacketConn) admit(addr *net.UDPAddr) (bool, error) {
+	f := c.flows.get(addr.IP, uint16(addr.Port))
+
+	f.mu.Lock()
+	if c.passive && f.state != flowEstablished {
+		f.mu.Unlock()
+		return false, nil
+	}
+	switch f.state {
+	case flowNew, flowSynSent, flowClosed:
+		if f.state == flowSynSent && time.Since(f.synAt) < synRetry {
+			f.mu.Unlock()
+			return false, nil
+		}
+		if f.state == flowClosed {
+			f.closed = make(chan struct{})
+		}
+		f.state = flowSynSent
+		f.synAt = time.Now()
+		f.seq = f.iss
+		f.mu.Unlock()
+		return false, c.sendHandle.write(nil, addr, flagSYN)
+	}
+	established := f.state == flowEstablished
+	f.mu.Unlock()
+	return established, nil
+}
+
+// handshake advances the emulated connection with addr for a received
+// segment carrying flags t, answering it when TCP would.
+func (c *PacketConn) handshake(addr *net.UDPAddr, t conf.TCPF) {
+	f := c.flows.get(addr.IP, uint16(addr.Port))
+
+	var reply *conf.TCPF
+	f.mu.Lock()
+	switch {
+	case t.RST:
+		f.close()
+	case t.SYN && !t.ACK:
+		if f.state == flowClosed {
+			f.closed = make(chan struct{})
+		}
+		f.state = flowSynRcvd
+		f.seq = f.iss
+		reply = &flagSYNACK
+	case t.SYN && t.ACK:
+		if f.state == flowSynSent || f.state == flowEstablished {
+			f.state = flowEstablished
+			reply = &flagACK
+		}
+	case t.FIN:
+		switch f.state {
+		case flowFinWait, flowClosed:
+			reply = &flagACK
+		default:
+			reply = &flagFINACK
+		}
+		f.close()
+	case f.state == flowNew || f.state == flowSynRcvd:
+		f.state = flowEstablished
+	}
+	f.mu.Unlock()
+
+	if reply != nil {
+		c.sendHandle.write(nil, addr, *reply)
+	}
+}
+
+// CloseFlow tears down the emulated connection with addr, exchanging FINs
+// first when handshakes are enabled, and forgets its state.
+func (c *PacketConn) CloseFlow(addr net.Addr) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	if c.cfg.TCP.Handshake {
+		f := c.flows.get(a.IP, uint16(a.Port))
+		f.mu.Lock()
+		open := f.state == flowEstablished || f.state == flowSynRcvd
+		if open {
+			f.state = flowFinWait
+		}
+		closed := f.closed
+		f.mu.Unlock()
+
+		if open && c.sendHandle.write(nil, a, flagFINACK) == nil {
+			select {
+			case <-closed:
+			case <-time.After(finWait):
+			}
+		}
+	}
+	c.flows.delete(a.IP, uint16(a.Port))
+}
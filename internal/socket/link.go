@@ -0,0 +1,98 @@
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// DLT_RAW is 12 on most platforms and 14 on OpenBSD; pcap may also report
+// the LINKTYPE_RAW value.
+const (
+	dltRaw12 layers.LinkType = 12
+	dltRaw14 layers.LinkType = 14
+)
+
+// linkKind groups the link types paqet can frame packets for.
+type linkKind uint8
+
+const (
+	linkEthernet linkKind = iota
+	linkRaw
+	linkNull
+	linkLoop
+	linkSLL
+	linkSLL2
+)
+
+func kindOf(lt layers.LinkType) (linkKind, error) {
+	switch lt {
+	case layers.LinkTypeEthernet:
+		return linkEthernet, nil
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6, dltRaw12, dltRaw14:
+		return linkRaw, nil
+	case layers.LinkTypeNull:
+		return linkNull, nil
+	case layers.LinkTypeLoop:
+		return linkLoop, nil
+	case layers.LinkTypeLinuxSLL:
+		return linkSLL, nil
+	case layers.LinkTypeLinuxSLL2:
+		return linkSLL2, nil
+	}
+	return 0, fmt.Errorf("unsupported link type %s", lt)
+}
+
+// headerLen is the length of the link header in front of the IP packet.
+func (k linkKind) headerLen() int {
+	switch k {
+	case linkNull, linkLoop:
+		return 4
+	case linkSLL:
+		return 16
+	case linkSLL2:
+		return 20
+	}
+	return 0
+}
+
+// afHeader is the 4-byte address family header of DLT_NULL (host byte
+// order) and DLT_LOOP (network byte order).
+type afHeader struct {
+	family uint32
+	order  binary.ByteOrder
+}
+
+func newAFHeader(k linkKind, ipv6 bool) *afHeader {
+	h := &afHeader{family: 2, order: binary.NativeEndian}
+	if k == linkLoop {
+		h.order = binary.BigEndian
+	}
+	if ipv6 {
+		switch runtime.GOOS {
+		case "darwin", "ios":
+			h.family = 30
+		case "freebsd", "dragonfly":
+			h.family = 28
+		case "windows":
+			h.family = 23
+		default:
+			h.family = 24
+		}
+	}
+	return h
+}
+
+func (h *afHeader) LayerType() gopacket.LayerType { return layers.LayerTypeLoopback }
+
+func (h *afHeader) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	bytes, err := b.PrependBytes(4)
+	if err != nil {
+		return err
+	}
+	h.order.PutUint32(bytes, h.family)
+	return nil
+}
@@ -0,0 +1,166 @@
+// Package memnet is an in-process socket.Backend. It links the PacketConns
+// opened on one Network through channels, so the full encoder, decoder and
+// transport stack can run without root or a real NIC:
+//
+//	socket.Register("memnet", memnet.New())
+//	cfg.Network.PCAP.Backend = "memnet"
+package memnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+)
+
+const (
+	queueLen    = 1024
+	readTimeout = 100 * time.Millisecond
+)
+
+// Network is a shared segment. Every frame written on it is delivered to the
+// receive handles that own the destination IP and whose filter accepts it.
+type Network struct {
+	mu    sync.RWMutex
+	ports []*port
+}
+
+func New() *Network {
+	return &Network{}
+}
+
+func (n *Network) OpenSend(cfg *conf.Network) (socket.Handle, error) {
+	return &sendHandle{net: n}, nil
+}
+
+func (n *Network) OpenRecv(cfg *conf.Network, filter string) (socket.Handle, error) {
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 65536, filter)
+	if err != nil {
+		return nil, fmt.Errorf("memnet: failed to compile filter %q: %v", filter, err)
+	}
+	p := &port{
+		net:  n,
+		bpf:  bpf,
+		ch:   make(chan []byte, queueLen),
+		done: make(chan struct{}),
+	}
+	if cfg.IPv4.Addr != nil {
+		p.ips = append(p.ips, cfg.IPv4.Addr.IP)
+	}
+	if cfg.IPv6.Addr != nil {
+		p.ips = append(p.ips, cfg.IPv6.Addr.IP)
+	}
+
+	n.mu.Lock()
+	n.ports = append(n.ports, p)
+	n.mu.Unlock()
+	return p, nil
+}
+
+func (n *Network) deliver(frame []byte) {
+	dst := dstIP(frame)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, p := range n.ports {
+		if dst != nil && !slices.ContainsFunc(p.ips, dst.Equal) {
+			continue
+		}
+		if !p.bpf.Matches(ci, frame) {
+			continue
+		}
+		select {
+		case p.ch <- frame:
+		default:
+		}
+	}
+}
+
+func (n *Network) detach(p *port) {
+	n.mu.Lock()
+	n.ports = slices.DeleteFunc(n.ports, func(q *port) bool { return q == p })
+	n.mu.Unlock()
+}
+
+// dstIP returns the destination of an Ethernet frame carrying IP, or nil for
+// anything else, which is then offered to every port.
+func dstIP(frame []byte) net.IP {
+	if len(frame) < 14 {
+		return nil
+	}
+	switch layers.EthernetType(binary.BigEndian.Uint16(frame[12:14])) {
+	case layers.EthernetTypeIPv4:
+		if len(frame) >= 14+20 {
+			return net.IP(frame[14+16 : 14+20])
+		}
+	case layers.EthernetTypeIPv6:
+		if len(frame) >= 14+40 {
+			return net.IP(frame[14+24 : 14+40])
+		}
+	}
+	return nil
+}
+
+type sendHandle struct {
+	net *Network
+}
+
+func (h *sendHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (h *sendHandle) WritePacketData(data []byte) error {
+	h.net.deliver(slices.Clone(data))
+	return nil
+}
+
+func (h *sendHandle) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+
+func (h *sendHandle) Close() {}
+
+type port struct {
+	net  *Network
+	ips  []net.IP
+	bpf  *pcap.BPF
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (p *port) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	timer := time.NewTimer(readTimeout)
+	defer timer.Stop()
+
+	select {
+	case frame := <-p.ch:
+		return frame, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}, nil
+	case <-timer.C:
+		return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+	case <-p.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+func (p *port) WritePacketData(data []byte) error {
+	return fmt.Errorf("memnet: receive handle cannot send")
+}
+
+func (p *port) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+
+func (p *port) Close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.net.detach(p)
+	})
+}
@@ -0,0 +1,187 @@
+package socket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/pcap"
+
+	"paqet/internal/conf"
+	"paqet/internal/pkg/hash"
+)
+
+const (
+	workerQueue = 256
+	readPoll    = 100 * time.Millisecond
+)
+
+// segment is a decoded inbound segment whose payload aliases buf.
+type segment struct {
+	buf     *[]byte
+	payload []byte
+	addr    *net.UDPAddr
+	flags   conf.TCPF
+	err     error
+}
+
+// pipeline spreads decoding over several workers. A capture goroutine per
+// receive handle copies frames out of the ring and hands each to the worker
+// owning its sender, so segments from one peer stay in order.
+type pipeline struct {
+	h    *RecvHandle
+	in   []chan *[]byte
+	out  chan segment
+	bufs sync.Pool
+	wg   sync.WaitGroup
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newPipeline(h *RecvHandle, workers int) *pipeline {
+	p := &pipeline{
+		h:    h,
+		in:   make([]chan *[]byte, workers),
+		out:  make(chan segment, workers*workerQueue),
+		done: make(chan struct{}),
+	}
+	p.bufs.New = func() any {
+		b := make([]byte, 0, 2048)
+		return &b
+	}
+	for i := range p.in {
+		p.in[i] = make(chan *[]byte, workerQueue)
+		p.wg.Add(1)
+		go p.work(p.in[i])
+	}
+	for _, handle := range h.handles {
+		p.wg.Add(1)
+		go p.capture(handle)
+	}
+	return p
+}
+
+func (p *pipeline) capture(handle Handle) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		data, _, err := handle.ZeroCopyReadPacketData()
+		if err != nil {
+			if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+				continue
+			}
+			p.halt(err)
+			return
+		}
+
+		buf := p.bufs.Get().(*[]byte)
+		*buf = append((*buf)[:0], data...)
+		w := p.in[peerHash(p.h.link, data)%uint64(len(p.in))]
+		select {
+		case w <- buf:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *pipeline) work(in chan *[]byte) {
+	defer p.wg.Done()
+	d := newDecoder()
+	for {
+		select {
+		case buf := <-in:
+			payload, addr, f, err := p.h.parse(d, *buf)
+			if addr == nil {
+				p.bufs.Put(buf)
+				continue
+			}
+			select {
+			case p.out <- segment{buf: buf, payload: payload, addr: addr, flags: f, err: err}:
+			case <-p.done:
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// read follows the Handle contract: it times out periodically so callers can
+// check deadlines, and reports io.EOF once the pipeline is stopped.
+func (p *pipeline) read(data []byte) (int, *net.UDPAddr, conf.TCPF, error) {
+	var s segment
+	select {
+	case s = <-p.out:
+	default:
+		t := time.NewTimer(readPoll)
+		defer t.Stop()
+		select {
+		case s = <-p.out:
+		case <-t.C:
+			return 0, nil, conf.TCPF{}, pcap.NextErrorTimeoutExpired
+		case <-p.done:
+			return 0, nil, conf.TCPF{}, p.err
+		}
+	}
+
+	n := copy(data, s.payload)
+	p.bufs.Put(s.buf)
+	return n, s.addr, s.flags, s.err
+}
+
+func (p *pipeline) halt(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// stop halts the pipeline and waits until no goroutine reads from the
+// handles, so they can be closed safely.
+func (p *pipeline) stop() {
+	p.halt(io.EOF)
+	p.wg.Wait()
+}
+
+// peerHash hashes the source address and port of frame without decoding it.
+func peerHash(link linkKind, frame []byte) uint64 {
+	off := link.headerLen()
+	if link == linkEthernet {
+		off = 14
+		for len(frame) >= off+4 && (frame[off-2] == 0x81 && frame[off-1] == 0x00 || frame[off-2] == 0x88 && frame[off-1] == 0xa8) {
+			off += 4
+		}
+	}
+	if len(frame) <= off {
+		return 0
+	}
+
+	var src net.IP
+	var port int
+	switch frame[off] >> 4 {
+	case 4:
+		ihl := int(frame[off]&0x0f) * 4
+		if len(frame) < off+20 || len(frame) < off+ihl+2 {
+			return 0
+		}
+		src, port = frame[off+12:off+16], off+ihl
+	case 6:
+		if len(frame) < off+42 {
+			return 0
+		}
+		src, port = frame[off+8:off+24], off+40
+	default:
+		return 0
+	}
+	return hash.IPAddr(src, uint16(frame[port])<<8|uint16(frame[port+1]))
+}
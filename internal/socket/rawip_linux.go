@@ -0,0 +1,60 @@
+//go:build linux
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// rawIPHandle injects complete IP packets through IPPROTO_RAW sockets and
+// lets the kernel route them. It backs sending on pseudo-devices such as
+// "any", where pcap cannot inject.
+type rawIPHandle struct {
+	fd4, fd6 int
+}
+
+func openRawIP() (Handle, error) {
+	fd4, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raw IPv4 socket: %v", err)
+	}
+	fd6, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		unix.Close(fd4)
+		return nil, fmt.Errorf("failed to open raw IPv6 socket: %v", err)
+	}
+	return &rawIPHandle{fd4: fd4, fd6: fd6}, nil
+}
+
+func (h *rawIPHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (h *rawIPHandle) WritePacketData(data []byte) error {
+	if len(data) >= 20 && data[0]>>4 == 4 {
+		sa := &unix.SockaddrInet4{}
+		copy(sa.Addr[:], data[16:20])
+		return unix.Sendto(h.fd4, data, 0, sa)
+	}
+	if len(data) >= 40 && data[0]>>4 == 6 {
+		sa := &unix.SockaddrInet6{}
+		copy(sa.Addr[:], data[24:40])
+		return unix.Sendto(h.fd6, data, 0, sa)
+	}
+	return net.InvalidAddrError("not an IP packet")
+}
+
+func (h *rawIPHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+func (h *rawIPHandle) Close() {
+	unix.Close(h.fd4)
+	unix.Close(h.fd6)
+}
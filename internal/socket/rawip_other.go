@@ -0,0 +1,9 @@
+//go:build !linux
+
+package socket
+
+import "fmt"
+
+func openRawIP() (Handle, error) {
+	return nil, fmt.Errorf("raw IP sockets are only supported on Linux")
+}
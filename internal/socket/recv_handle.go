@@ -1,78 +1,137 @@
 package socket
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
-	"runtime"
 	"slices"
 	"sync"
-	"time"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 
 	"paqet/internal/conf"
 )
 
 type decoder struct {
 	parser  *gopacket.DecodingLayerParser
+	parser4 *gopacket.DecodingLayerParser
+	parser6 *gopacket.DecodingLayerParser
 	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
 	ip4     layers.IPv4
 	ip6     layers.IPv6
 	tcp     layers.TCP
 	decoded []gopacket.LayerType
 }
 
+// decode parses a frame of the given link kind down to TCP.
+func (d *decoder) decode(link linkKind, frame []byte) error {
+	if link == linkEthernet {
+		return d.parser.DecodeLayers(frame, &d.decoded)
+	}
+	n := link.headerLen()
+	if len(frame) <= n {
+		return errNoPayload
+	}
+	frame = frame[n:]
+	switch frame[0] >> 4 {
+	case 4:
+		return d.parser4.DecodeLayers(frame, &d.decoded)
+	case 6:
+		return d.parser6.DecodeLayers(frame, &d.decoded)
+	}
+	return errNoPayload
+}
+
 type RecvHandle struct {
-	handle *pcap.Handle
-	dPool  sync.Pool
-	mu     sync.Mutex
+	handles []Handle
+	link    linkKind
+	flows   *flowTable
+	dPool   sync.Pool
+	mu      sync.Mutex
+	pipe    *pipeline
 }
 
-func NewRecvHandle(cfg *conf.Network) (*RecvHandle, error) {
-	handle, err := newHandle(cfg, cfg.PCAP.Sockbuf, 65536, 100*time.Millisecond)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open pcap handle: %w", err)
+func NewRecvHandle(cfg *conf.Network, b Backend, flows *flowTable) (*RecvHandle, error) {
+	filter := fmt.Sprintf("tcp and dst port %d", cfg.Port)
+	if cfg.VLAN.ID != 0 {
+		base := filter
+		filter = fmt.Sprintf("%s or (vlan and %s)", base, base)
+		if cfg.VLAN.Outer != 0 {
+			filter += fmt.Sprintf(" or (vlan and vlan and %s)", base)
+		}
 	}
 
-	// SetDirection is not fully supported on Windows Npcap, so skip it
-	if runtime.GOOS != "windows" {
-		if err := handle.SetDirection(pcap.DirectionIn); err != nil {
-			return nil, fmt.Errorf("failed to set pcap direction in: %v", err)
+	h := &RecvHandle{flows: flows}
+	for range max(cfg.PCAP.Fanout, 1) {
+		handle, err := b.OpenRecv(cfg, filter)
+		if err != nil {
+			h.closeHandles()
+			return nil, fmt.Errorf("failed to open receive handle: %w", err)
 		}
+		h.handles = append(h.handles, handle)
 	}
 
-	filter := fmt.Sprintf("tcp and dst port %d", cfg.Port)
-	if err := handle.SetBPFFilter(filter); err != nil {
-		return nil, fmt.Errorf("failed to set BPF filter: %w", err)
+	link, err := kindOf(h.handles[0].LinkType())
+	if err != nil {
+		h.closeHandles()
+		return nil, fmt.Errorf("failed to open receive handle: %w", err)
 	}
+	h.link = link
 
-	h := &RecvHandle{handle: handle}
-	h.dPool.New = func() any {
-		d := &decoder{decoded: make([]gopacket.LayerType, 0, 4)}
-		d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &d.eth, &d.ip4, &d.ip6, &d.tcp)
-		d.parser.IgnoreUnsupported = true
-		return d
+	h.dPool.New = func() any { return newDecoder() }
+
+	if cfg.PCAP.Workers > 1 || len(h.handles) > 1 {
+		h.pipe = newPipeline(h, max(cfg.PCAP.Workers, 1))
 	}
 
 	return h, nil
 }
 
-func (h *RecvHandle) Read(data []byte) (int, net.Addr, error) {
+func newDecoder() *decoder {
+	d := &decoder{decoded: make([]gopacket.LayerType, 0, 6)}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp)
+	d.parser4 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &d.ip4, &d.tcp)
+	d.parser6 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &d.ip6, &d.tcp)
+	for _, p := range []*gopacket.DecodingLayerParser{d.parser, d.parser4, d.parser6} {
+		p.IgnoreUnsupported = true
+	}
+	return d
+}
+
+// Read returns the payload of the next inbound segment together with its
+// sender and TCP flags. Segments without payload report errNoPayload; the
+// address and flags are still set when the segment could be decoded.
+func (h *RecvHandle) Read(data []byte) (int, *net.UDPAddr, conf.TCPF, error) {
+	if h.pipe != nil {
+		return h.pipe.read(data)
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	zdata, _, err := h.handle.ZeroCopyReadPacketData()
+	zdata, _, err := h.handles[0].ZeroCopyReadPacketData()
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, conf.TCPF{}, err
 	}
 
 	d := h.dPool.Get().(*decoder)
 	defer h.dPool.Put(d)
 
-	if err := d.parser.DecodeLayers(zdata, &d.decoded); err != nil {
-		return 0, nil, errNoPayload
+	payload, addr, f, err := h.parse(d, zdata)
+	if err != nil {
+		return 0, addr, f, err
+	}
+
+	return copy(data, payload), addr, f, nil
+}
+
+// parse decodes frame with d and records the segment in its flow. The
+// returned payload aliases frame.
+func (h *RecvHandle) parse(d *decoder, frame []byte) ([]byte, *net.UDPAddr, conf.TCPF, error) {
+	if err := d.decode(h.link, frame); err != nil {
+		return nil, nil, conf.TCPF{}, errNoPayload
 	}
 
 	addr := &net.UDPAddr{}
@@ -89,15 +148,41 @@ func (h *RecvHandle) Read(data []byte) (int, net.Addr, error) {
 		}
 	}
 
-	if addr.IP == nil || len(payload) == 0 {
-		return 0, nil, errNoPayload
+	if addr.IP == nil {
+		return nil, nil, conf.TCPF{}, errNoPayload
+	}
+	tsVal, hasTS := tcpTSVal(&d.tcp)
+	h.flows.get(addr.IP, uint16(addr.Port)).observe(d.tcp.Seq, len(payload), d.tcp.SYN, d.tcp.FIN, tsVal, hasTS)
+
+	t := &d.tcp
+	f := conf.TCPF{FIN: t.FIN, SYN: t.SYN, RST: t.RST, PSH: t.PSH, ACK: t.ACK, URG: t.URG, ECE: t.ECE, CWR: t.CWR, NS: t.NS}
+	if len(payload) == 0 {
+		return nil, addr, f, errNoPayload
 	}
 
-	return copy(data, payload), addr, nil
+	return payload, addr, f, nil
 }
 
 func (h *RecvHandle) Close() {
-	if h.handle != nil {
-		h.handle.Close()
+	if h.pipe != nil {
+		h.pipe.stop()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeHandles()
+}
+
+func (h *RecvHandle) closeHandles() {
+	for _, handle := range h.handles {
+		handle.Close()
+	}
+}
+
+func tcpTSVal(tcp *layers.TCP) (uint32, bool) {
+	for _, o := range tcp.Options {
+		if o.OptionType == layers.TCPOptionKindTimestamps && len(o.OptionData) == 8 {
+			return binary.BigEndian.Uint32(o.OptionData[0:4]), true
+		}
 	}
+	return 0, false
 }
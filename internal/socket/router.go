@@ -0,0 +1,224 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+
+	"paqet/internal/flog"
+)
+
+const (
+	routerRefresh = 30 * time.Second
+	probeTimeout  = time.Second
+	probeAttempts = 3
+)
+
+// resolveRouter finds the MAC of the default gateway, first in the kernel
+// neighbor table and then by asking for it on the wire.
+func (h *SendHandle) resolveRouter(ipv6 bool) (net.HardwareAddr, error) {
+	gw, err := defaultGateway(h.iface, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	if mac, err := neighbor(h.iface, gw); err == nil {
+		return mac, nil
+	}
+	mac, err := h.probeRouter(gw, ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve MAC of gateway %s: %v", gw, err)
+	}
+	return mac, nil
+}
+
+func (h *SendHandle) updateRouter(ipv6 bool) error {
+	mac, err := h.resolveRouter(ipv6)
+	if err != nil {
+		return err
+	}
+	p := &h.srcIPv4RHWA
+	if ipv6 {
+		p = &h.srcIPv6RHWA
+	}
+	if old := p.Swap(&mac); old == nil {
+		flog.Infof("resolved router MAC %s on %s", mac, h.iface.Name)
+	} else if old.String() != mac.String() {
+		flog.Infof("router MAC on %s changed from %s to %s", h.iface.Name, *old, mac)
+	}
+	return nil
+}
+
+func (h *SendHandle) watchRouter(v4, v6 bool) {
+	t := time.NewTicker(routerRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if v4 {
+				if err := h.updateRouter(false); err != nil {
+					flog.Warnf("failed to refresh IPv4 router MAC: %v", err)
+				}
+			}
+			if v6 {
+				if err := h.updateRouter(true); err != nil {
+					flog.Warnf("failed to refresh IPv6 router MAC: %v", err)
+				}
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// probeRouter sends an ARP request or an NDP neighbor solicitation for gw
+// and waits for the answer on a temporary receive handle.
+func (h *SendHandle) probeRouter(gw net.IP, ipv6 bool) (net.HardwareAddr, error) {
+	filter := "arp and arp[6:2] = 2"
+	if ipv6 {
+		filter = "icmp6 and ip6[40] = 136"
+	}
+	rh, err := h.backend.OpenRecv(h.cfg, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer rh.Close()
+
+	var req []byte
+	if ipv6 {
+		req, err = h.buildNS(gw)
+	} else {
+		req, err = h.buildARP(gw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for range probeAttempts {
+		h.writeMu.Lock()
+		err := h.handle.WritePacketData(req)
+		h.writeMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(probeTimeout)
+		for time.Now().Before(deadline) {
+			data, _, err := rh.ZeroCopyReadPacketData()
+			if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if mac := parseNeighborReply(data, gw); mac != nil {
+				return mac, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no reply after %d attempts", probeAttempts)
+}
+
+func (h *SendHandle) buildARP(gw net.IP) ([]byte, error) {
+	eth := layers.Ethernet{
+		SrcMAC:       h.iface.HardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   h.iface.HardwareAddr,
+		SourceProtAddress: h.srcIPv4.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    gw.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &eth, &arp); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *SendHandle) buildNS(gw net.IP) ([]byte, error) {
+	gw = gw.To16()
+	// Solicited-node multicast address and its MAC.
+	dst := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, gw[13], gw[14], gw[15]}
+	eth := layers.Ethernet{
+		SrcMAC:       h.iface.HardwareAddr,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, dst[12], dst[13], dst[14], dst[15]},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      h.srcIPv6,
+		DstIP:      dst,
+	}
+	icmp := layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	icmp.SetNetworkLayerForChecksum(&ip6)
+	ns := layers.ICMPv6NeighborSolicitation{
+		TargetAddress: gw,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: h.iface.HardwareAddr},
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, &eth, &ip6, &icmp, &ns); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseNeighborReply(data []byte, gw net.IP) net.HardwareAddr {
+	p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+	if l, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		if l.Operation == layers.ARPReply && net.IP(l.SourceProtAddress).Equal(gw) {
+			return slices.Clone(net.HardwareAddr(l.SourceHwAddress))
+		}
+		return nil
+	}
+	if l, ok := p.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement); ok {
+		if !l.TargetAddress.Equal(gw) {
+			return nil
+		}
+		for _, o := range l.Options {
+			if o.Type == layers.ICMPv6OptTargetAddress && len(o.Data) == 6 {
+				return slices.Clone(net.HardwareAddr(o.Data))
+			}
+		}
+		if eth, ok := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+			return slices.Clone(eth.SrcMAC)
+		}
+	}
+	return nil
+}
+
+var zeroMAC = make(net.HardwareAddr, 6)
+
+// orZero returns mac, or the all-zero MAC if there is none, as on loopback,
+// which is framed as Ethernet but has no hardware addresses.
+func orZero(mac net.HardwareAddr) net.HardwareAddr {
+	if len(mac) == 0 {
+		return zeroMAC
+	}
+	return mac
+}
+
+func loadMAC(p *atomic.Pointer[net.HardwareAddr]) net.HardwareAddr {
+	if mac := p.Load(); mac != nil {
+		return *mac
+	}
+	return nil
+}
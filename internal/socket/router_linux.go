@@ -0,0 +1,110 @@
+//go:build linux
+
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultGateway returns the next hop of the main-table default route that
+// leaves through iface.
+func defaultGateway(iface *net.Interface, ipv6 bool) (net.IP, error) {
+	family := unix.AF_INET
+	if ipv6 {
+		family = unix.AF_INET6
+	}
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump routing table: %v", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routing table: %v", err)
+	}
+
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWROUTE || len(m.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		rt := (*unix.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if rt.Dst_len != 0 || rt.Table != unix.RT_TABLE_MAIN {
+			continue
+		}
+		var gw net.IP
+		oif := -1
+		for typ, data := range netlinkAttrs(m.Data[unix.SizeofRtMsg:]) {
+			switch typ {
+			case unix.RTA_GATEWAY:
+				gw = net.IP(data)
+			case unix.RTA_OIF:
+				if len(data) >= 4 {
+					oif = int(binary.NativeEndian.Uint32(data))
+				}
+			}
+		}
+		if gw != nil && oif == iface.Index {
+			return gw, nil
+		}
+	}
+	return nil, fmt.Errorf("no default gateway via %s", iface.Name)
+}
+
+// neighbor looks ip up in the kernel neighbor table of iface.
+func neighbor(iface *net.Interface, ip net.IP) (net.HardwareAddr, error) {
+	family := unix.AF_INET
+	if ip.To4() == nil {
+		family = unix.AF_INET6
+	}
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETNEIGH, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump neighbor table: %v", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse neighbor table: %v", err)
+	}
+
+	const usable = unix.NUD_REACHABLE | unix.NUD_STALE | unix.NUD_DELAY | unix.NUD_PROBE | unix.NUD_PERMANENT
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		nd := (*unix.NdMsg)(unsafe.Pointer(&m.Data[0]))
+		if int(nd.Ifindex) != iface.Index || nd.State&usable == 0 {
+			continue
+		}
+		var dst net.IP
+		var mac net.HardwareAddr
+		for typ, data := range netlinkAttrs(m.Data[unix.SizeofNdMsg:]) {
+			switch typ {
+			case unix.NDA_DST:
+				dst = net.IP(data)
+			case unix.NDA_LLADDR:
+				mac = net.HardwareAddr(data)
+			}
+		}
+		if dst.Equal(ip) && len(mac) == 6 {
+			return mac, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not in neighbor table of %s", ip, iface.Name)
+}
+
+func netlinkAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs[binary.NativeEndian.Uint16(b[2:4])] = b[unix.SizeofRtAttr:l]
+		b = b[min((l+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1), len(b)):]
+	}
+	return attrs
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package socket
+
+import (
+	"fmt"
+	"net"
+)
+
+func defaultGateway(iface *net.Interface, ipv6 bool) (net.IP, error) {
+	return nil, fmt.Errorf("router discovery is only supported on Linux")
+}
+
+func neighbor(iface *net.Interface, ip net.IP) (net.HardwareAddr, error) {
+	return nil, fmt.Errorf("router discovery is only supported on Linux")
+}
@@ -3,15 +3,13 @@ package socket
 import (
 	"encoding/binary"
 	"fmt"
+	"math/rand/v2"
 	"net"
-	"runtime"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 
 	"paqet/internal/conf"
 	"paqet/internal/pkg/hash"
@@ -25,73 +23,127 @@ type tcpF struct {
 }
 
 type encoder struct {
-	eth layers.Ethernet
-	ip4 layers.IPv4
-	ip6 layers.IPv6
-	tcp layers.TCP
+	eth   layers.Ethernet
+	outer layers.Dot1Q
+	inner layers.Dot1Q
+	ip4   layers.IPv4
+	ip6   layers.IPv6
+	tcp   layers.TCP
 
-	opts [5]layers.TCPOption
+	opts [10]layers.TCPOption
 	ts   [8]byte
 	mss  [2]byte
 	ws   [1]byte
 
-	buf gopacket.SerializeBuffer
+	layers [7]gopacket.SerializableLayer
+	buf    gopacket.SerializeBuffer
 }
 
 type SendHandle struct {
-	handle      *pcap.Handle
+	handle      Handle
+	link        linkKind
+	af4, af6    *afHeader
+	backend     Backend
+	cfg         *conf.Network
+	iface       *net.Interface
 	writeMu     sync.Mutex
 	srcIPv4     net.IP
-	srcIPv4RHWA net.HardwareAddr
+	srcIPv4RHWA atomic.Pointer[net.HardwareAddr]
 	srcIPv6     net.IP
-	srcIPv6RHWA net.HardwareAddr
+	srcIPv6RHWA atomic.Pointer[net.HardwareAddr]
 	srcPort     uint16
-	time        uint32
-	tsCounter   atomic.Uint32
+	fp          conf.Fingerprint
+	vlan        conf.VLAN
+	dscp        atomic.Int32
+	ipid        atomic.Uint32
+	flows       *flowTable
 	tcpF        tcpF
 	ePool       sync.Pool
+	bufs        sync.Pool
+	done        chan struct{}
+	closeOnce   sync.Once
 }
 
-func NewSendHandle(cfg *conf.Network) (*SendHandle, error) {
-	handle, err := newHandle(cfg, 256*1024, 128, pcap.BlockForever)
+func NewSendHandle(cfg *conf.Network, b Backend, flows *flowTable) (*SendHandle, error) {
+	handle, err := b.OpenSend(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open pcap handle: %w", err)
+		return nil, fmt.Errorf("failed to open send handle: %w", err)
 	}
 
-	// SetDirection is not fully supported on Windows Npcap, so skip it
-	if runtime.GOOS != "windows" {
-		if err := handle.SetDirection(pcap.DirectionOut); err != nil {
-			return nil, fmt.Errorf("failed to set pcap direction out: %v", err)
-		}
+	link, err := kindOf(handle.LinkType())
+	if err == nil && (link == linkSLL || link == linkSLL2) {
+		err = fmt.Errorf("link type %s cannot be used to send", handle.LinkType())
 	}
-
-	if err := handle.SetBPFFilter("less 0"); err != nil {
-		return nil, fmt.Errorf("failed to set BPF filter: %w", err)
+	if err == nil && link != linkEthernet && cfg.VLAN.ID != 0 {
+		err = fmt.Errorf("VLAN tagging requires an Ethernet link, not %s", handle.LinkType())
+	}
+	if err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to open send handle: %w", err)
 	}
 
 	sh := &SendHandle{
 		handle:  handle,
+		link:    link,
+		af4:     newAFHeader(link, false),
+		af6:     newAFHeader(link, true),
+		backend: b,
+		cfg:     cfg,
+		iface:   cfg.Interface,
 		srcPort: uint16(cfg.Port),
+		fp:      cfg.TCP.Profile,
+		vlan:    cfg.VLAN,
+		flows:   flows,
 		tcpF:    tcpF{tcpF: iterator.Iterator[conf.TCPF]{Items: cfg.TCP.LF}, clientTCPF: make(map[uint64]*iterator.Iterator[conf.TCPF])},
-		time:    uint32(time.Now().UnixNano() / int64(time.Millisecond)),
+		done:    make(chan struct{}),
+		bufs: sync.Pool{
+			New: func() any {
+				b := make([]byte, 0, 2048)
+				return &b
+			},
+		},
 		ePool: sync.Pool{
 			New: func() any {
 				return &encoder{
-					eth: layers.Ethernet{SrcMAC: cfg.Interface.HardwareAddr},
-					mss: [2]byte{0x05, 0xb4},
-					ws:  [1]byte{8},
+					eth: layers.Ethernet{SrcMAC: orZero(cfg.Interface.HardwareAddr)},
+					mss: [2]byte{byte(cfg.TCP.Profile.MSS >> 8), byte(cfg.TCP.Profile.MSS)},
+					ws:  [1]byte{byte(*cfg.TCP.Profile.WScale)},
 					buf: gopacket.NewSerializeBuffer(),
 				}
 			},
 		},
 	}
+	sh.dscp.Store(-1)
+	sh.ipid.Store(rand.Uint32())
 	if cfg.IPv4.Addr != nil {
 		sh.srcIPv4 = cfg.IPv4.Addr.IP
-		sh.srcIPv4RHWA = cfg.IPv4.Router
+		if cfg.IPv4.Router != nil {
+			sh.srcIPv4RHWA.Store(&cfg.IPv4.Router)
+		}
 	}
 	if cfg.IPv6.Addr != nil {
 		sh.srcIPv6 = cfg.IPv6.Addr.IP
-		sh.srcIPv6RHWA = cfg.IPv6.Router
+		if cfg.IPv6.Router != nil {
+			sh.srcIPv6RHWA.Store(&cfg.IPv6.Router)
+		}
+	}
+
+	v4Auto := link == linkEthernet && cfg.IPv4.Addr != nil && cfg.IPv4.RouterAuto
+	v6Auto := link == linkEthernet && cfg.IPv6.Addr != nil && cfg.IPv6.RouterAuto
+	if v4Auto {
+		if err := sh.updateRouter(false); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to resolve IPv4 router MAC: %v", err)
+		}
+	}
+	if v6Auto {
+		if err := sh.updateRouter(true); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to resolve IPv6 router MAC: %v", err)
+		}
+	}
+	if v4Auto || v6Auto {
+		go sh.watchRouter(v4Auto, v6Auto)
 	}
 	return sh, nil
 }
@@ -100,8 +152,8 @@ func (h *SendHandle) buildIPv4Header(e *encoder, dstIP net.IP) {
 	e.ip4 = layers.IPv4{
 		Version:  4,
 		IHL:      5,
-		TOS:      184,
-		TTL:      64,
+		TOS:      h.nextTOS(),
+		TTL:      h.nextTTL(),
 		Flags:    layers.IPv4DontFragment,
 		Protocol: layers.IPProtocolTCP,
 		SrcIP:    h.srcIPv4,
@@ -109,60 +161,124 @@ func (h *SendHandle) buildIPv4Header(e *encoder, dstIP net.IP) {
 	}
 }
 
+func (h *SendHandle) nextIPID(fl *flow) uint16 {
+	switch h.fp.IPID {
+	case "global":
+		return uint16(h.ipid.Add(1))
+	case "flow":
+		return fl.nextID()
+	case "random":
+		return uint16(rand.Uint32())
+	}
+	return 0
+}
+
 func (h *SendHandle) buildIPv6Header(e *encoder, dstIP net.IP) {
 	e.ip6 = layers.IPv6{
 		Version:      6,
-		TrafficClass: 184,
-		HopLimit:     64,
+		TrafficClass: h.nextTOS(),
+		HopLimit:     h.nextTTL(),
 		NextHeader:   layers.IPProtocolTCP,
 		SrcIP:        h.srcIPv6,
 		DstIP:        dstIP,
 	}
 }
 
-func (h *SendHandle) buildTCPHeader(e *encoder, dstPort uint16, f conf.TCPF) {
+func (h *SendHandle) buildTCPHeader(e *encoder, fl *flow, dstPort uint16, f conf.TCPF, n int) {
 	e.tcp = layers.TCP{
 		SrcPort: layers.TCPPort(h.srcPort),
 		DstPort: layers.TCPPort(dstPort),
 		FIN:     f.FIN, SYN: f.SYN, RST: f.RST, PSH: f.PSH, ACK: f.ACK, URG: f.URG, ECE: f.ECE, CWR: f.CWR, NS: f.NS,
-		Window: 65535,
 	}
 
-	counter := h.tsCounter.Add(1)
-	tsVal := h.time + (counter >> 3)
-	opts := e.opts[:0]
+	seq, ack, tsVal, tsEcr := fl.next(n, f.SYN, f.FIN)
+	e.tcp.Seq = seq
+	if f.ACK {
+		e.tcp.Ack = ack
+	}
+	if f.SYN && !f.ACK {
+		tsEcr = 0
+	}
+	binary.BigEndian.PutUint32(e.ts[0:4], tsVal)
+	binary.BigEndian.PutUint32(e.ts[4:8], tsEcr)
+
+	layout := h.fp.Options
 	if f.SYN {
-		binary.BigEndian.PutUint32(e.ts[0:4], tsVal)
-		binary.BigEndian.PutUint32(e.ts[4:8], 0)
-		opts = append(opts,
-			layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: e.mss[:]},
-			layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
-			layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: e.ts[:]},
-			layers.TCPOption{OptionType: layers.TCPOptionKindNop},
-			layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: e.ws[:]},
-		)
-		e.tcp.Seq = 1 + (counter & 0x7)
-		e.tcp.Ack = 0
-		if f.ACK {
-			e.tcp.Ack = e.tcp.Seq + 1
-		}
+		layout = h.fp.SynOptions
+		e.tcp.Window = uint16(h.fp.SynWindow)
 	} else {
-		tsEcr := tsVal - (counter%200 + 50)
-		binary.BigEndian.PutUint32(e.ts[0:4], tsVal)
-		binary.BigEndian.PutUint32(e.ts[4:8], tsEcr)
-		opts = append(opts,
-			layers.TCPOption{OptionType: layers.TCPOptionKindNop},
-			layers.TCPOption{OptionType: layers.TCPOptionKindNop},
-			layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: e.ts[:]},
-		)
-		seq := h.time + (counter << 7)
-		e.tcp.Seq = seq
-		e.tcp.Ack = seq - (counter & 0x3FF) + 1400
+		e.tcp.Window = h.window()
+	}
+	e.tcp.Options = h.options(e, layout)
+}
+
+func (h *SendHandle) window() uint16 {
+	return uint16(pick(h.fp.Window))
+}
+
+func (h *SendHandle) nextTTL() uint8 {
+	return uint8(pick(h.fp.TTL))
+}
+
+// nextTOS picks the TOS from the profile, with its DSCP bits replaced when
+// one was set through SetDSCP.
+func (h *SendHandle) nextTOS() uint8 {
+	tos := pick(h.fp.TOS)
+	if d := h.dscp.Load(); d >= 0 {
+		tos = int(d)<<2 | tos&0x3
 	}
-	e.tcp.Options = opts
+	return uint8(tos)
+}
+
+func pick(r conf.Range) int {
+	if r.Min == r.Max {
+		return r.Min
+	}
+	return r.Min + rand.IntN(r.Max-r.Min+1)
+}
+
+// options lays out the TCP options named in layout, pointing their values at
+// the encoder's buffers.
+func (h *SendHandle) options(e *encoder, layout []string) []layers.TCPOption {
+	opts := e.opts[:0]
+	for _, o := range layout {
+		switch o {
+		case "mss":
+			opts = append(opts, layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: e.mss[:]})
+		case "sack_perm":
+			opts = append(opts, layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2})
+		case "ts":
+			opts = append(opts, layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: e.ts[:]})
+		case "nop":
+			opts = append(opts, layers.TCPOption{OptionType: layers.TCPOptionKindNop})
+		case "ws":
+			opts = append(opts, layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: e.ws[:]})
+		case "eol":
+			opts = append(opts, layers.TCPOption{OptionType: layers.TCPOptionKindEndList})
+		}
+	}
+	return opts
 }
 
 func (h *SendHandle) Write(payload []byte, addr *net.UDPAddr) error {
+	return h.write(payload, addr, h.getClientTCPF(addr.IP, uint16(addr.Port)))
+}
+
+func (h *SendHandle) write(payload []byte, addr *net.UDPAddr, f conf.TCPF) error {
+	fl := h.flows.get(addr.IP, uint16(addr.Port))
+	if f.SYN {
+		return h.writeLayers(payload, addr, fl, f)
+	}
+	hd, err := h.header(fl, addr)
+	if err != nil {
+		return err
+	}
+	return h.writeHeader(hd, payload, fl, f)
+}
+
+// writeLayers serializes the whole frame through gopacket. It is used for
+// SYNs, whose options differ from the header template.
+func (h *SendHandle) writeLayers(payload []byte, addr *net.UDPAddr, fl *flow, f conf.TCPF) error {
 	e := h.ePool.Get().(*encoder)
 	defer func() {
 		e.buf.Clear()
@@ -172,31 +288,59 @@ func (h *SendHandle) Write(payload []byte, addr *net.UDPAddr) error {
 	dstIP := addr.IP
 	dstPort := uint16(addr.Port)
 
-	h.buildTCPHeader(e, dstPort, h.getClientTCPF(dstIP, dstPort))
-
-	var ipLayer gopacket.SerializableLayer
+	h.buildTCPHeader(e, fl, dstPort, f, len(payload))
+	ls := h.frame(e, dstIP)
 	if dstIP.To4() != nil {
-		h.buildIPv4Header(e, dstIP)
-		ipLayer = &e.ip4
-		e.tcp.SetNetworkLayerForChecksum(&e.ip4)
-		e.eth.DstMAC = h.srcIPv4RHWA
-		e.eth.EthernetType = layers.EthernetTypeIPv4
-	} else {
-		h.buildIPv6Header(e, dstIP)
-		ipLayer = &e.ip6
-		e.tcp.SetNetworkLayerForChecksum(&e.ip6)
-		e.eth.DstMAC = h.srcIPv6RHWA
-		e.eth.EthernetType = layers.EthernetTypeIPv6
+		e.ip4.Id = h.nextIPID(fl)
 	}
+	ls = append(ls, &e.tcp, gopacket.Payload(payload))
 
 	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	if err := gopacket.SerializeLayers(e.buf, opts, &e.eth, ipLayer, &e.tcp, gopacket.Payload(payload)); err != nil {
+	if err := gopacket.SerializeLayers(e.buf, opts, ls...); err != nil {
 		return err
 	}
+	return h.send(e.buf.Bytes())
+}
 
-	// pcap_sendpacket is not guaranteed thread-safe.
+// frame returns the link and IP layers for a packet to dstIP, and hooks the
+// TCP layer up for checksumming.
+func (h *SendHandle) frame(e *encoder, dstIP net.IP) []gopacket.SerializableLayer {
+	ls := e.layers[:0]
+	ipv6 := dstIP.To4() == nil
+	switch h.link {
+	case linkEthernet:
+		e.eth.DstMAC = orZero(loadMAC(&h.srcIPv4RHWA))
+		ipType := layers.EthernetTypeIPv4
+		if ipv6 {
+			e.eth.DstMAC = orZero(loadMAC(&h.srcIPv6RHWA))
+			ipType = layers.EthernetTypeIPv6
+		}
+		ls = append(ls, &e.eth)
+		ls = h.appendVLAN(e, ls, ipType)
+	case linkNull, linkLoop:
+		if ipv6 {
+			ls = append(ls, h.af6)
+		} else {
+			ls = append(ls, h.af4)
+		}
+	}
+	if ipv6 {
+		h.buildIPv6Header(e, dstIP)
+		e.tcp.SetNetworkLayerForChecksum(&e.ip6)
+		ls = append(ls, &e.ip6)
+	} else {
+		h.buildIPv4Header(e, dstIP)
+		e.tcp.SetNetworkLayerForChecksum(&e.ip4)
+		ls = append(ls, &e.ip4)
+	}
+	return ls
+}
+
+func (h *SendHandle) send(frame []byte) error {
+	// pcap_sendpacket is not guaranteed thread-safe, and neither are
+	// the other backends.
 	h.writeMu.Lock()
-	err := h.handle.WritePacketData(e.buf.Bytes())
+	err := h.handle.WritePacketData(frame)
 	h.writeMu.Unlock()
 	return err
 }
@@ -231,7 +375,32 @@ func (h *SendHandle) deleteClientTCPF(addr net.Addr) {
 }
 
 func (h *SendHandle) Close() {
-	if h.handle != nil {
-		h.handle.Close()
+	h.closeOnce.Do(func() {
+		close(h.done)
+		if h.handle != nil {
+			h.handle.Close()
+		}
+	})
+}
+
+// appendVLAN adds the configured 802.1Q tags after the Ethernet header and
+// sets the EtherTypes that chain them to the IP layer.
+func (h *SendHandle) appendVLAN(e *encoder, ls []gopacket.SerializableLayer, ipType layers.EthernetType) []gopacket.SerializableLayer {
+	v := h.vlan
+	if v.ID == 0 {
+		e.eth.EthernetType = ipType
+		return ls
+	}
+	e.inner = layers.Dot1Q{Priority: uint8(v.Priority), VLANIdentifier: uint16(v.ID), Type: ipType}
+	if v.Outer == 0 {
+		e.eth.EthernetType = layers.EthernetTypeDot1Q
+		return append(ls, &e.inner)
 	}
+	e.eth.EthernetType = layers.EthernetTypeQinQ
+	e.outer = layers.Dot1Q{Priority: uint8(v.Priority), VLANIdentifier: uint16(v.Outer), Type: layers.EthernetTypeDot1Q}
+	return append(ls, &e.outer, &e.inner)
+}
+
+func (h *SendHandle) setDSCP(dscp int) {
+	h.dscp.Store(int32(dscp))
 }
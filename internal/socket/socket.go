@@ -18,6 +18,8 @@ type PacketConn struct {
 	cfg           *conf.Network
 	sendHandle    *SendHandle
 	recvHandle    *RecvHandle
+	flows         *flowTable
+	passive       bool
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
 }
@@ -27,14 +29,22 @@ func New(cfg *conf.Network) (*PacketConn, error) {
 		cfg.Port = 32768 + rand.Intn(32768)
 	}
 
-	sendHandle, err := NewSendHandle(cfg)
+	b, err := backend(cfg.PCAP.Backend)
 	if err != nil {
+		return nil, err
+	}
+
+	flows := newFlowTable()
+	sendHandle, err := NewSendHandle(cfg, b, flows)
+	if err != nil {
+		flows.close()
 		return nil, fmt.Errorf("failed to create send handle on %s: %v", cfg.Interface.Name, err)
 	}
 
-	recvHandle, err := NewRecvHandle(cfg)
+	recvHandle, err := NewRecvHandle(cfg, b, flows)
 	if err != nil {
 		sendHandle.Close()
+		flows.close()
 		return nil, fmt.Errorf("failed to create receive handle on %s: %v", cfg.Interface.Name, err)
 	}
 
@@ -42,6 +52,7 @@ func New(cfg *conf.Network) (*PacketConn, error) {
 		cfg:        cfg,
 		sendHandle: sendHandle,
 		recvHandle: recvHandle,
+		flows:      flows,
 	}
 
 	return conn, nil
@@ -53,7 +64,10 @@ func (c *PacketConn) ReadFrom(data []byte) (n int, addr net.Addr, err error) {
 			return 0, nil, os.ErrDeadlineExceeded
 		}
 
-		n, addr, err := c.recvHandle.Read(data)
+		n, addr, f, err := c.recvHandle.Read(data)
+		if addr != nil && c.cfg.TCP.Handshake {
+			c.handshake(addr, f)
+		}
 		if err != nil {
 			if errors.Is(err, pcap.NextErrorTimeoutExpired) || errors.Is(err, errNoPayload) {
 				continue
@@ -75,6 +89,15 @@ func (c *PacketConn) WriteTo(data []byte, addr net.Addr) (n int, err error) {
 		return 0, net.InvalidAddrError("invalid address")
 	}
 
+	if c.cfg.TCP.Handshake {
+		ok, err := c.admit(daddr)
+		if !ok {
+			// Payload sent before the handshake completes is dropped; KCP
+			// retransmits it.
+			return len(data), err
+		}
+	}
+
 	err = c.sendHandle.Write(data, daddr)
 	if err != nil {
 		return 0, err
@@ -90,16 +113,23 @@ func (c *PacketConn) Close() error {
 	if c.recvHandle != nil {
 		c.recvHandle.Close()
 	}
+	if c.flows != nil {
+		c.flows.close()
+	}
 	return nil
 }
 
+// LocalAddr is the IPv4 address, or the IPv6 one on IPv6-only setups, with
+// the port the emulated TCP connections use.
 func (c *PacketConn) LocalAddr() net.Addr {
-	return nil
-	// return &net.UDPAddr{
-	// 	IP:   append([]byte(nil), c.cfg.PrimaryAddr().IP...),
-	// 	Port: c.cfg.PrimaryAddr().Port,
-	// 	Zone: c.cfg.PrimaryAddr().Zone,
-	// }
+	a := c.cfg.IPv4.Addr
+	if a == nil {
+		a = c.cfg.IPv6.Addr
+	}
+	if a == nil {
+		return &net.UDPAddr{Port: c.cfg.Port}
+	}
+	return &net.UDPAddr{IP: a.IP, Port: c.cfg.Port, Zone: a.Zone}
 }
 
 func (c *PacketConn) SetDeadline(t time.Time) error {
@@ -118,7 +148,16 @@ func (c *PacketConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// SetReadBuffer and SetWriteBuffer accept any size: the capture buffers are
+// sized by pcap.sockbuf when the handles open.
+func (c *PacketConn) SetReadBuffer(bytes int) error  { return nil }
+func (c *PacketConn) SetWriteBuffer(bytes int) error { return nil }
+
 func (c *PacketConn) SetDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP value %d", dscp)
+	}
+	c.sendHandle.setDSCP(dscp)
 	return nil
 }
 
@@ -0,0 +1,31 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+
+	"paqet/internal/conf"
+)
+
+// UDPConn carries packets over an ordinary UDP socket, for
+// transport.carrier udp. It needs neither pcap nor raw socket privileges, and
+// the TCP emulation hooks of PacketConn do nothing on it.
+type UDPConn struct {
+	*net.UDPConn
+}
+
+func NewUDP(cfg *conf.Network) (*UDPConn, error) {
+	conn, err := net.ListenUDP("udp", cfg.Bind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP %s: %v", cfg.Bind, err)
+	}
+	// The buffer size is a hint; the kernel caps it at its own limits.
+	conn.SetReadBuffer(cfg.PCAP.Sockbuf)
+	conn.SetWriteBuffer(cfg.PCAP.Sockbuf)
+	return &UDPConn{conn}, nil
+}
+
+func (c *UDPConn) Passive()                                   {}
+func (c *UDPConn) CloseFlow(addr net.Addr)                    {}
+func (c *UDPConn) SetClientTCPF(addr net.Addr, f []conf.TCPF) {}
+func (c *UDPConn) DeleteClientTCPF(addr net.Addr)             {}
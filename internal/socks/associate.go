@@ -2,23 +2,34 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"sync"
 
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
 	"paqet/internal/tnet"
 )
 
+// associate is one UDP_ASSOCIATE. When the server supports associations,
+// all of its datagrams share strm and leave the server from one socket,
+// so replies from any host reach the client; otherwise each destination
+// gets a stream of its own.
 type associate struct {
 	conn  *net.UDPConn
 	cAddr *net.UDPAddr
+	strm  *protocol.AssocStrm
+	mu    sync.Mutex
 }
 
 func (a *associate) accept(cAddr *net.UDPAddr) bool {
 	if !cAddr.IP.Equal(a.cAddr.IP) {
 		return false
 	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	if a.cAddr.Port == 0 {
 		a.cAddr.Port = cAddr.Port
 	}
@@ -29,6 +40,16 @@ func (s *Server) handleAssociate(ctx context.Context, tConn net.Conn, req *reque
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	strm, _, err := s.client.Associate(ctx)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		flog.Errorf("SOCKS5 failed to establish UDP association for %s: %v", tConn.RemoteAddr(), err)
+		s.write(tConn, reply(err))
+		return
+	}
+	if strm != nil {
+		defer strm.Close()
+	}
+
 	lAddr := tConn.LocalAddr().(*net.TCPAddr)
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: lAddr.IP, Port: 0})
 	if err != nil {
@@ -43,7 +64,7 @@ func (s *Server) handleAssociate(ctx context.Context, tConn net.Conn, req *reque
 		return
 	}
 
-	a := &associate{conn: conn, cAddr: &net.UDPAddr{}}
+	a := &associate{conn: conn, cAddr: &net.UDPAddr{}, strm: strm}
 	if req.atyp == atypDomain || net.IP(req.addr).IsUnspecified() {
 		a.cAddr.IP = tConn.RemoteAddr().(*net.TCPAddr).IP
 	} else {
@@ -60,6 +81,13 @@ func (s *Server) handleAssociate(ctx context.Context, tConn net.Conn, req *reque
 		conn.Close()
 		tConn.Close()
 	})
+	if strm != nil {
+		flog.Infof("SOCKS5 accepted UDP association %d from %s", strm.SID(), tConn.RemoteAddr())
+		go func() {
+			s.assocToUDP(a)
+			conn.Close()
+		}()
+	}
 
 	s.serveUDP(ctx, a)
 	flog.Debugf("SOCKS5 UDP_ASSOCIATE control connection %s closed", tConn.RemoteAddr())
@@ -85,10 +113,51 @@ func (s *Server) serveUDP(ctx context.Context, a *associate) {
 			flog.Debugf("SOCKS5 UDP %s: malformed datagram: %v", cAddr, err)
 			continue
 		}
+		if a.strm != nil {
+			s.udpToAssoc(a, d)
+			continue
+		}
 		s.udpToStrm(ctx, a, d)
 	}
 }
 
+func (s *Server) udpToAssoc(a *associate, d *datagram) {
+	addr, err := tnet.NewAddr(d.address())
+	if err != nil {
+		flog.Debugf("SOCKS5 UDP %s: invalid destination %s: %v", a.cAddr, d.address(), err)
+		return
+	}
+	if err := a.strm.WriteTo(d.data, addr); errors.Is(err, protocol.ErrDatagramSize) {
+		flog.Errorf("SOCKS5 UDP %s -> %s: %v", a.cAddr, d.address(), err)
+	} else if err != nil {
+		flog.Debugf("SOCKS5 UDP %s -> %s: %v", a.cAddr, d.address(), err)
+	}
+}
+
+// assocToUDP relays datagrams from the association to the client, each
+// headed with the address it came from.
+func (s *Server) assocToUDP(a *associate) {
+	buf := make([]byte, buffer.UDPSize)
+	for {
+		n, from, err := a.strm.ReadFrom(buf)
+		if err != nil {
+			flog.Debugf("SOCKS5 UDP association %d closed: %v", a.strm.SID(), err)
+			return
+		}
+		a.mu.Lock()
+		cAddr := *a.cAddr
+		a.mu.Unlock()
+		ip := net.ParseIP(from.Host)
+		if ip == nil || cAddr.Port == 0 {
+			continue
+		}
+		p := append([]byte{0, 0, 0}, putAddr(nil, ip, from.Port)...)
+		if _, err := a.conn.WriteToUDP(append(p, buf[:n]...), &cAddr); err != nil {
+			return
+		}
+	}
+}
+
 func (s *Server) udpToStrm(ctx context.Context, a *associate, d *datagram) {
 	if len(d.data) > buffer.UDPSize {
 		flog.Debugf("SOCKS5 UDP %s -> %s: payload too large, %d bytes", a.cAddr, d.address(), len(d.data))
@@ -2,24 +2,33 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"net"
 
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
 )
 
 func (s *Server) handleConnect(ctx context.Context, conn net.Conn, req *request) {
-	strm, err := s.client.TCP(ctx, req.address())
+	strm, bound, err := s.client.TCP(ctx, req.address())
 	if err != nil {
 		flog.Errorf("SOCKS5 failed to establish TCP stream for %s -> %s: %v", conn.RemoteAddr(), req.address(), err)
-		s.write(conn, repFailure)
+		s.write(conn, reply(err))
 		return
 	}
 	defer strm.Close()
 	flog.Infof("SOCKS5 accepted TCP connection %s -> %s", conn.RemoteAddr(), req.address())
 
+	// BND.ADDR is where the server connected from, if it said.
 	lAddr := conn.LocalAddr().(*net.TCPAddr)
-	if _, err := conn.Write(append([]byte{ver, repSuccess, 0x00}, putAddr(nil, lAddr.IP, lAddr.Port)...)); err != nil {
+	bIP, bPort := lAddr.IP, lAddr.Port
+	if bound != nil {
+		if ip := net.ParseIP(bound.Host); ip != nil {
+			bIP, bPort = ip, bound.Port
+		}
+	}
+	if _, err := conn.Write(append([]byte{ver, repSuccess, 0x00}, putAddr(nil, bIP, bPort)...)); err != nil {
 		return
 	}
 
@@ -37,3 +46,22 @@ func (s *Server) handleConnect(ctx context.Context, conn net.Conn, req *request)
 
 	flog.Debugf("SOCKS5 connection %s -> %s closed", conn.RemoteAddr(), req.address())
 }
+
+// reply maps a failed TCP dial onto a SOCKS5 reply code.
+func reply(err error) byte {
+	var de *protocol.DialError
+	if !errors.As(err, &de) {
+		return repFailure
+	}
+	switch de.Code {
+	case protocol.RDENIED:
+		return repNotAllowed
+	case protocol.RNETUNREACH:
+		return repNetUnreach
+	case protocol.RHOSTUNREACH, protocol.RTIMEOUT, protocol.RDNS:
+		return repHostUnreach
+	case protocol.RREFUSED:
+		return repRefused
+	}
+	return repFailure
+}
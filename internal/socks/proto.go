@@ -22,9 +22,13 @@ const (
 	atypDomain = 0x03
 	atypIPv6   = 0x04
 
-	repSuccess   = 0x00
-	repFailure   = 0x01
-	repCmdUnsupp = 0x07
+	repSuccess     = 0x00
+	repFailure     = 0x01
+	repNotAllowed  = 0x02
+	repNetUnreach  = 0x03
+	repHostUnreach = 0x04
+	repRefused     = 0x05
+	repCmdUnsupp   = 0x07
 )
 
 var errProtocol = errors.New("socks: protocol error")
@@ -16,3 +16,18 @@ type Conn interface {
 	SetReadDeadline(t time.Time) error
 	SetWriteDeadline(t time.Time) error
 }
+
+// UserConn is a Conn whose peer authenticated as User.
+type UserConn struct {
+	Conn
+	User string
+}
+
+// User returns the identity attached to c, or "" if its peer did not
+// authenticate.
+func User(c Conn) string {
+	if uc, ok := c.(*UserConn); ok {
+		return uc.User
+	}
+	return ""
+}
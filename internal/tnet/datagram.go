@@ -0,0 +1,9 @@
+package tnet
+
+// DatagramConn is a Conn that can also carry unreliable datagrams next to
+// its streams.
+type DatagramConn interface {
+	Conn
+	SendDatagram(b []byte) error
+	ReceiveDatagram() ([]byte, error)
+}
@@ -0,0 +1,8 @@
+package tnet
+
+// Dialer opens connections to one server. Closing it ends every connection
+// dialed through it.
+type Dialer interface {
+	Dial() (Conn, error)
+	Close() error
+}
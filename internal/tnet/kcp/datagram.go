@@ -0,0 +1,92 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"paqet/internal/tnet/mux"
+)
+
+// Datagrams travel as kcp-go out-of-band packets: an FEC header of type
+// typeOOB, the conversation ID and the payload. They are sealed like the
+// session's own packets but never enter KCP, so a lost one is simply gone.
+const oobHeaderSize = fecHeaderSize + 4
+
+var errDatagramTooLarge = errors.New("kcp: datagram too large")
+
+var oobBufs = sync.Pool{New: func() any {
+	b := make([]byte, 0, mtuLimit)
+	return &b
+}}
+
+// isOOB reports whether the decrypted packet p is a datagram.
+func isOOB(p []byte) bool {
+	return len(p) >= oobHeaderSize && binary.LittleEndian.Uint16(p[4:]) == typeOOB
+}
+
+// datagrams is the unreliable channel of one session.
+type datagrams struct {
+	conv  uint32
+	max   int
+	write func(p []byte) error
+	in    chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newDatagrams(conv uint32, max, queue int, write func(p []byte) error) *datagrams {
+	return &datagrams{conv: conv, max: max, write: write, in: make(chan []byte, queue), done: make(chan struct{})}
+}
+
+func (d *datagrams) send(b []byte) error {
+	if len(b) > d.max {
+		return errDatagramTooLarge
+	}
+	select {
+	case <-d.done:
+		return net.ErrClosed
+	default:
+	}
+	buf := oobBufs.Get().(*[]byte)
+	defer oobBufs.Put(buf)
+	p := binary.LittleEndian.AppendUint32((*buf)[:0], 0xffffffff)
+	p = binary.LittleEndian.AppendUint16(p, typeOOB)
+	p = binary.LittleEndian.AppendUint16(p, uint16(2+4+len(b)))
+	p = binary.LittleEndian.AppendUint32(p, d.conv)
+	*buf = append(p, b...)
+	return d.write(*buf)
+}
+
+// deliver queues the payload of the datagram p, dropping it when the
+// reader falls behind.
+func (d *datagrams) deliver(p []byte) {
+	b := append([]byte(nil), p[oobHeaderSize:]...)
+	select {
+	case d.in <- b:
+	default:
+	}
+}
+
+func (d *datagrams) receive() ([]byte, error) {
+	select {
+	case b := <-d.in:
+		return b, nil
+	case <-d.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (d *datagrams) close() {
+	d.once.Do(func() { close(d.done) })
+}
+
+// Conn is a KCP session that also carries datagrams beside its streams.
+type Conn struct {
+	*mux.Conn
+	dg *datagrams
+}
+
+func (c *Conn) SendDatagram(b []byte) error      { return c.dg.send(b) }
+func (c *Conn) ReceiveDatagram() ([]byte, error) { return c.dg.receive() }
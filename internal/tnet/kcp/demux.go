@@ -0,0 +1,193 @@
+package kcp
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xtaci/kcp-go/v5"
+
+	"paqet/internal/flog"
+)
+
+// kcp-go wire format constants.
+const (
+	nonceSize     = 16
+	crcSize       = 4
+	fecHeaderSize = 8
+	kcpOverhead   = 24
+	typeData      = 0xf1
+	typeParity    = 0xf2
+	typeOOB       = 0xf3
+	mtuLimit      = 1500
+)
+
+// crypter seals and opens packets in kcp-go's wire format. Sessions sharing
+// a PacketConn run without a block of their own and leave encryption to the
+// crypter, so each packet is decrypted once and its conversation ID can be
+// read before it is handed to a session.
+//
+// With a sequenced block, nonces are a random per-crypter prefix followed
+// by a packet counter, and the receiving crypter drops any nonce it has
+// already seen.
+type crypter struct {
+	block   kcp.BlockCrypt
+	aead    cipher.AEAD
+	bufs    sync.Pool
+	prefix  []byte
+	counter atomic.Uint64
+	replay  *replayFilter
+	replays atomic.Uint64
+}
+
+func newCrypter(block kcp.BlockCrypt, sequenced bool) *crypter {
+	c := &crypter{block: block}
+	c.aead, _ = block.(cipher.AEAD)
+	if c.aead != nil && sequenced {
+		c.prefix = make([]byte, c.aead.NonceSize()-8)
+		rand.Read(c.prefix)
+		c.replay = newReplayFilter()
+	}
+	c.bufs.New = func() any {
+		b := make([]byte, 0, mtuLimit)
+		return &b
+	}
+	return c
+}
+
+// overhead is the number of bytes sealing adds to a packet.
+func (c *crypter) overhead() int {
+	switch {
+	case c.block == nil:
+		return 0
+	case c.aead != nil:
+		return c.aead.NonceSize() + c.aead.Overhead()
+	}
+	return nonceSize + crcSize
+}
+
+func (c *crypter) seal(dst, p []byte) []byte {
+	switch {
+	case c.block == nil:
+		return append(dst, p...)
+	case c.aead != nil:
+		n := c.aead.NonceSize()
+		dst = append(dst, make([]byte, n)...)
+		nonce := dst[len(dst)-n:]
+		if c.replay != nil {
+			copy(nonce, c.prefix)
+			binary.BigEndian.PutUint64(nonce[len(c.prefix):], c.counter.Add(1))
+		} else {
+			rand.Read(nonce)
+		}
+		return c.aead.Seal(dst, nonce, p, nil)
+	}
+	start := len(dst)
+	dst = append(dst, make([]byte, nonceSize+crcSize)...)
+	dst = append(dst, p...)
+	b := dst[start:]
+	rand.Read(b[:nonceSize])
+	binary.LittleEndian.PutUint32(b[nonceSize:], crc32.ChecksumIEEE(b[nonceSize+crcSize:]))
+	c.block.Encrypt(b, b)
+	return dst
+}
+
+// open decrypts b in place and reports whether it was intact.
+func (c *crypter) open(b []byte) ([]byte, bool) {
+	switch {
+	case c.block == nil:
+		return b, true
+	case c.aead != nil:
+		n := c.aead.NonceSize()
+		if len(b) < n+c.aead.Overhead() {
+			return nil, false
+		}
+		p, err := c.aead.Open(b[n:n], b[:n], b[n:], nil)
+		if err != nil {
+			return nil, false
+		}
+		if c.replay != nil && !c.replay.accept(b[:n-8], binary.BigEndian.Uint64(b[n-8:n])) {
+			if r := c.replays.Add(1); r&(r-1) == 0 {
+				flog.Warnf("kcp: dropped replayed packet (%d so far)", r)
+			}
+			return nil, false
+		}
+		return p, true
+	}
+	if len(b) < nonceSize+crcSize {
+		return nil, false
+	}
+	c.block.Decrypt(b, b)
+	if crc32.ChecksumIEEE(b[nonceSize+crcSize:]) != binary.LittleEndian.Uint32(b[nonceSize:]) {
+		return nil, false
+	}
+	return b[nonceSize+crcSize:], true
+}
+
+// writeTo seals p and sends it to addr on pc.
+func (c *crypter) writeTo(pc net.PacketConn, p []byte, addr net.Addr) (int, error) {
+	b := c.bufs.Get().(*[]byte)
+	defer c.bufs.Put(b)
+	*b = c.seal((*b)[:0], p)
+	if _, err := pc.WriteTo(*b, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type fecGroup struct {
+	peer  uint64
+	group uint32
+	conv  uint32
+}
+
+// router finds the conversation a decrypted packet belongs to. FEC parity
+// shards carry no conversation ID; they go to the owner of the data shards
+// last seen in their group, remembered in a small ring. A parity shard that
+// lands in the wrong session fails its conversation check there and KCP
+// retransmits instead.
+type router struct {
+	shards uint32
+	mu     sync.Mutex
+	groups [256]fecGroup
+}
+
+func newRouter(dshard, pshard int) *router {
+	return &router{shards: uint32(dshard + pshard)}
+}
+
+func (r *router) conv(peer uint64, p []byte) (uint32, bool) {
+	if len(p) < fecHeaderSize+4 {
+		return 0, false
+	}
+	switch binary.LittleEndian.Uint16(p[4:]) {
+	case typeData:
+		conv := binary.LittleEndian.Uint32(p[fecHeaderSize:])
+		if r.shards > 0 {
+			g := binary.LittleEndian.Uint32(p) / r.shards
+			r.mu.Lock()
+			r.groups[(peer^uint64(g))%uint64(len(r.groups))] = fecGroup{peer: peer, group: g, conv: conv}
+			r.mu.Unlock()
+		}
+		return conv, true
+	case typeParity:
+		if r.shards == 0 {
+			return 0, false
+		}
+		g := binary.LittleEndian.Uint32(p) / r.shards
+		r.mu.Lock()
+		e := r.groups[(peer^uint64(g))%uint64(len(r.groups))]
+		r.mu.Unlock()
+		return e.conv, e.peer == peer && e.group == g
+	case typeOOB:
+		return binary.LittleEndian.Uint32(p[fecHeaderSize:]), true
+	}
+	if len(p) < kcpOverhead {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(p), true
+}
@@ -2,36 +2,223 @@ package kcp
 
 import (
 	"fmt"
+	"math/rand/v2"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
 
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
+	"paqet/internal/tnet/mux"
 )
 
-func Dial(addr *net.UDPAddr, cfg *conf.KCP, netCfg conf.Network) (tnet.Conn, error) {
+// Dialer opens KCP connections to one server over a single PacketConn and
+// routes inbound packets to their sessions by conversation ID.
+type Dialer struct {
+	addr       *net.UDPAddr
+	cfg        *conf.KCP
+	user       *conf.User
+	packetConn socket.Carrier
+	crypt      *crypter
+	router     *router
+	mu         sync.RWMutex
+	convs      map[uint32]*sessionConn
+	bufs       sync.Pool
+}
+
+// NewDialer returns a Dialer for the server at addr. With user set, pfs
+// handshakes are keyed with the user's key instead of the transport's.
+func NewDialer(addr *net.UDPAddr, cfg *conf.Transport, netCfg conf.Network, user *conf.User) (*Dialer, error) {
 	nCfg := netCfg
-	packetConn, err := socket.New(&nCfg)
+	packetConn, err := socket.NewCarrier(cfg, &nCfg)
 	if err != nil {
 		return nil, fmt.Errorf("kcp: failed to create packetconn: %w", err)
 	}
 
-	conn, err := kcp.NewConn(addr.String(), cfg.Block, cfg.Dshard, cfg.Pshard, packetConn)
+	d := &Dialer{
+		addr:       addr,
+		cfg:        cfg.KCP,
+		user:       user,
+		packetConn: packetConn,
+		crypt:      newCrypter(cfg.KCP.Block, cfg.KCP.Sequenced),
+		router:     newRouter(cfg.KCP.Dshard, cfg.KCP.Pshard),
+		convs:      make(map[uint32]*sessionConn),
+	}
+	d.bufs.New = func() any {
+		b := make([]byte, 0, mtuLimit)
+		return &b
+	}
+	go d.demux()
+	return d, nil
+}
+
+func (d *Dialer) Dial() (tnet.Conn, error) {
+	sc := d.register(!d.cfg.PFS)
+	conn, err := kcp.NewConn3(sc.conv, d.addr, nil, d.cfg.Dshard, d.cfg.Pshard, sc)
 	if err != nil {
-		packetConn.Close()
+		sc.Close()
 		return nil, fmt.Errorf("kcp: failed to dial connection: %w", err)
 	}
-	aplConf(conn, cfg)
+	aplConf(conn, d.cfg, d.crypt.overhead())
 
-	sess, err := smux.Client(conn, smuxConf(cfg))
+	var c net.Conn = conn
+	if d.cfg.PFS {
+		name, psk := "", d.cfg.PFSKey
+		if d.user != nil {
+			name, psk = d.user.Name, d.user.Secret
+		}
+		if c, err = clientHandshake(conn, name, psk); err != nil {
+			conn.Close()
+			sc.Close()
+			return nil, fmt.Errorf("kcp: handshake with %s failed: %w", d.addr, err)
+		}
+	}
+	sess, err := smux.Client(c, smuxConf(d.cfg))
 	if err != nil {
 		conn.Close()
-		packetConn.Close()
+		sc.Close()
 		return nil, fmt.Errorf("kcp: failed to create smux session: %w", err)
 	}
 
-	return &Conn{packetConn, conn, sess}, nil
+	mc := &mux.Conn{Conn: c, Session: sess, Release: func() { sc.Close() }}
+	if sc.dg == nil {
+		return mc, nil
+	}
+	return &Conn{Conn: mc, dg: sc.dg}, nil
+}
+
+// Close tears down the emulated TCP connection and the PacketConn, which
+// ends every session dialed through d.
+func (d *Dialer) Close() error {
+	d.packetConn.CloseFlow(d.addr)
+	return d.packetConn.Close()
+}
+
+// register reserves a conversation for a new session, with a datagram
+// channel if withDatagrams is set. Sessions under pfs go without one, as
+// datagrams are only sealed with the block.
+func (d *Dialer) register(withDatagrams bool) *sessionConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conv := rand.Uint32()
+	for conv == 0 || d.convs[conv] != nil {
+		conv = rand.Uint32()
+	}
+	sc := &sessionConn{d: d, conv: conv, in: make(chan *[]byte, d.cfg.Rcvwnd), done: make(chan struct{})}
+	if withDatagrams {
+		max := d.cfg.MTU - d.crypt.overhead() - oobHeaderSize
+		sc.dg = newDatagrams(conv, max, d.cfg.Rcvwnd, func(p []byte) error {
+			_, err := d.crypt.writeTo(d.packetConn, p, d.addr)
+			return err
+		})
+	}
+	d.convs[conv] = sc
+	return sc
+}
+
+func (d *Dialer) demux() {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := d.packetConn.ReadFrom(buf)
+		if err != nil {
+			flog.Debugf("kcp: stopped reading from %s: %v", d.addr, err)
+			d.mu.Lock()
+			for _, sc := range d.convs {
+				sc.close()
+			}
+			d.mu.Unlock()
+			return
+		}
+		if a, ok := addr.(*net.UDPAddr); !ok || !a.IP.Equal(d.addr.IP) || a.Port != d.addr.Port {
+			continue
+		}
+		p, ok := d.crypt.open(buf[:n])
+		if !ok {
+			continue
+		}
+		conv, ok := d.router.conv(0, p)
+		if !ok {
+			continue
+		}
+		d.mu.RLock()
+		sc := d.convs[conv]
+		d.mu.RUnlock()
+		switch {
+		case sc == nil:
+		case isOOB(p):
+			if sc.dg != nil {
+				sc.dg.deliver(p)
+			}
+		default:
+			sc.deliver(p)
+		}
+	}
+}
+
+// sessionConn is the net.PacketConn a single session of a Dialer sees. It
+// carries plaintext; the Dialer seals and opens packets for it.
+type sessionConn struct {
+	d    *Dialer
+	conv uint32
+	in   chan *[]byte
+	dg   *datagrams
+	done chan struct{}
+	once sync.Once
+}
+
+// deliver queues p for the session, dropping it when the session falls
+// behind as a full socket buffer would.
+func (c *sessionConn) deliver(p []byte) {
+	b := c.d.bufs.Get().(*[]byte)
+	*b = append((*b)[:0], p...)
+	select {
+	case c.in <- b:
+	default:
+		c.d.bufs.Put(b)
+	}
 }
+
+func (c *sessionConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case b := <-c.in:
+		n := copy(p, *b)
+		c.d.bufs.Put(b)
+		return n, c.d.addr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *sessionConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.d.crypt.writeTo(c.d.packetConn, p, c.d.addr)
+}
+
+func (c *sessionConn) Close() error {
+	c.d.mu.Lock()
+	delete(c.d.convs, c.conv)
+	c.d.mu.Unlock()
+	c.close()
+	return nil
+}
+
+func (c *sessionConn) close() {
+	c.once.Do(func() { close(c.done) })
+	if c.dg != nil {
+		c.dg.close()
+	}
+}
+
+func (c *sessionConn) LocalAddr() net.Addr                { return c.d.packetConn.LocalAddr() }
+func (c *sessionConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sessionConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sessionConn) SetWriteDeadline(t time.Time) error { return nil }
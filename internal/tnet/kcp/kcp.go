@@ -2,12 +2,15 @@ package kcp
 
 import (
 	"paqet/internal/conf"
+	"paqet/internal/tnet/mux"
 
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
 )
 
-func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
+// aplConf tunes a session; overhead is what the shared PacketConn adds to
+// each packet on top of the session's own MTU.
+func aplConf(conn *kcp.UDPSession, cfg *conf.KCP, overhead int) {
 	var noDelay, interval, resend, noCongestion int
 	var wDelay, ackNoDelay bool
 	switch cfg.Mode {
@@ -30,20 +33,14 @@ func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
 
 	conn.SetNoDelay(noDelay, interval, resend, noCongestion)
 	conn.SetWindowSize(cfg.Sndwnd, cfg.Rcvwnd)
-	conn.SetMtu(cfg.MTU)
+	conn.SetMtu(cfg.MTU - overhead)
 	conn.SetWriteDelay(wDelay)
 	conn.SetACKNoDelay(ackNoDelay)
 	conn.SetStreamMode(true)
-	conn.SetDSCP(46)
+	// No SetDSCP: the TOS of crafted packets comes from the fingerprint
+	// profile, and no common OS marks its TCP traffic EF by default.
 }
 
 func smuxConf(cfg *conf.KCP) *smux.Config {
-	var sconf = smux.DefaultConfig()
-	sconf.Version = 2
-	sconf.KeepAliveInterval = cfg.Smuxkalive
-	sconf.KeepAliveTimeout = cfg.Smuxktimeout
-	sconf.MaxFrameSize = 65535
-	sconf.MaxReceiveBuffer = cfg.Smuxbuf
-	sconf.MaxStreamBuffer = cfg.Streambuf
-	return sconf
+	return mux.Config(cfg.Smuxbuf, cfg.Streambuf, cfg.Smuxkalive, cfg.Smuxktimeout)
 }
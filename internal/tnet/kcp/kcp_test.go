@@ -0,0 +1,108 @@
+package kcp_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	kcpgo "github.com/xtaci/kcp-go/v5"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+	"paqet/internal/socket/memnet"
+	"paqet/internal/tnet/kcp"
+)
+
+func init() {
+	socket.Register("memnet", memnet.New())
+}
+
+func memnetConfig(ip string, port int) conf.Network {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	n := conf.Network{
+		Interface: &net.Interface{Name: "mem0", Index: 1, HardwareAddr: mac},
+		Port:      port,
+	}
+	n.IPv4.Addr = &net.UDPAddr{IP: net.ParseIP(ip).To4(), Port: port}
+	n.IPv4.Router = mac
+	n.PCAP = conf.PCAP{Backend: "memnet", Sockbuf: 1 << 20, Workers: 1, Fanout: 1}
+	n.TCP.LF = []conf.TCPF{{PSH: true, ACK: true}}
+	n.TCP.RF = []conf.TCPF{{PSH: true, ACK: true}}
+	wscale := 7
+	n.TCP.Profile = conf.Fingerprint{
+		TTL: conf.Range{Min: 64, Max: 64}, IPID: "flow", SynWindow: 64240, Window: conf.Range{Min: 501, Max: 4096}, WScale: &wscale, MSS: 1460,
+		SynOptions: []string{"mss", "sack_perm", "ts", "nop", "ws"}, Options: []string{"nop", "nop", "ts"},
+	}
+	return n
+}
+
+func transport(t *testing.T) *conf.Transport {
+	block, err := kcpgo.NewAESBlockCrypt(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &conf.Transport{Protocol: "kcp", KCP: &conf.KCP{
+		Mode: "fast", MTU: 1350, Rcvwnd: 512, Sndwnd: 512, Block: block,
+		Smuxbuf: 4 << 20, Streambuf: 2 << 20, Smuxkalive: 2 * time.Second, Smuxktimeout: 10 * time.Second,
+	}}
+}
+
+// TestMemnet runs a KCP session between a dialer and a listener whose
+// packets cross memnet as crafted Ethernet/IPv4/TCP frames.
+func TestMemnet(t *testing.T) {
+	l, err := kcp.Listen(transport(t), memnetConfig("10.0.0.1", 9999))
+	if err != nil {
+		if strings.Contains(err.Error(), "failed to compile filter") {
+			t.Skipf("libpcap cannot compile filters here: %v", err)
+		}
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			strm, err := conn.AcceptStrm()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(strm, strm)
+				strm.Close()
+			}()
+		}
+	}()
+
+	d, err := kcp.NewDialer(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9999}, transport(t), memnetConfig("10.0.0.2", 40000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strm.Close()
+
+	msg := bytes.Repeat([]byte("paqet"), 20000)
+	go strm.Write(msg)
+	got := make([]byte, len(msg))
+	strm.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(strm, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echoed data does not match")
+	}
+}
@@ -3,52 +3,184 @@ package kcp
 import (
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
 
 	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/hash"
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
+	"paqet/internal/tnet/mux"
 )
 
 type Listener struct {
-	PacketConn *socket.PacketConn
+	PacketConn socket.Carrier
 	cfg        *conf.KCP
 	listener   *kcp.Listener
+	crypt      *crypter
+	dgrams     *dgTable
+	conns      chan tnet.Conn
+	done       chan struct{}
+	once       sync.Once
+	mu         sync.Mutex
+	peers      map[string]int
+	users      atomic.Pointer[map[string][]byte]
 }
 
-func Listen(cfg *conf.KCP, netCfg conf.Network) (tnet.Listener, error) {
+func Listen(cfg *conf.Transport, netCfg conf.Network) (tnet.Listener, error) {
 	nCfg := netCfg
-	packetConn, err := socket.New(&nCfg)
+	packetConn, err := socket.NewCarrier(cfg, &nCfg)
 	if err != nil {
 		return nil, fmt.Errorf("kcp: failed to create packetconn: %w", err)
 	}
+	packetConn.Passive()
 
-	l, err := kcp.ServeConn(cfg.Block, cfg.Dshard, cfg.Pshard, packetConn)
+	k := cfg.KCP
+	crypt := newCrypter(k.Block, k.Sequenced)
+	dgrams := &dgTable{m: make(map[string]*datagrams)}
+	cc := &convConn{Carrier: packetConn, crypt: crypt, router: newRouter(k.Dshard, k.Pshard), dgrams: dgrams}
+	l, err := kcp.ServeConn(nil, k.Dshard, k.Pshard, cc)
 	if err != nil {
 		packetConn.Close()
 		return nil, fmt.Errorf("kcp: failed to serve connection: %w", err)
 	}
 
-	return &Listener{PacketConn: packetConn, cfg: cfg, listener: l}, nil
+	ln := &Listener{
+		PacketConn: packetConn,
+		cfg:        k,
+		listener:   l,
+		crypt:      crypt,
+		dgrams:     dgrams,
+		conns:      make(chan tnet.Conn),
+		done:       make(chan struct{}),
+		peers:      make(map[string]int),
+	}
+	go ln.accept()
+	return ln, nil
 }
 
-func (l *Listener) Accept() (tnet.Conn, error) {
-	conn, err := l.listener.AcceptKCP()
-	if err != nil {
-		return nil, fmt.Errorf("kcp: failed to accept connection: %w", err)
+func (l *Listener) accept() {
+	for {
+		conn, err := l.listener.AcceptKCP()
+		if err != nil {
+			l.once.Do(func() { close(l.done) })
+			return
+		}
+		go l.serve(conn)
+	}
+}
+
+// serve runs the pfs handshake, if enabled, and hands the session to
+// Accept. Handshakes run off the accept loop, so a slow client does not hold
+// up the others.
+func (l *Listener) serve(conn *kcp.UDPSession) {
+	aplConf(conn, l.cfg, l.crypt.overhead())
+	raddr := peerAddr(conn.RemoteAddr())
+	var c net.Conn = conn
+	if l.cfg.PFS {
+		var err error
+		if c, err = serverHandshake(conn, l.psk); err != nil {
+			flog.Debugf("kcp: handshake with %s failed: %v", raddr, err)
+			conn.Close()
+			return
+		}
 	}
-	aplConf(conn, l.cfg)
-	sess, err := smux.Server(conn, smuxConf(l.cfg))
+	sess, err := smux.Server(c, smuxConf(l.cfg))
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("kcp: failed to create smux session: %w", err)
+		return
+	}
+	l.acquire(raddr)
+	release := func() { l.release(raddr) }
+	// Sessions under pfs go without datagrams, as those are only sealed
+	// with the block.
+	var dg *datagrams
+	if !l.cfg.PFS {
+		a := conn.RemoteAddr().(*convAddr)
+		dg = newDatagrams(a.conv, l.cfg.MTU-l.crypt.overhead()-oobHeaderSize, l.cfg.Rcvwnd, func(p []byte) error {
+			_, err := l.crypt.writeTo(l.PacketConn, p, a.UDPAddr)
+			return err
+		})
+		l.dgrams.add(a.String(), dg)
+		release = func() {
+			l.dgrams.remove(a.String())
+			l.release(raddr)
+		}
+	}
+	mc := &mux.Conn{Conn: c, Session: sess, Release: release}
+	var tc tnet.Conn = mc
+	if dg != nil {
+		tc = &Conn{Conn: mc, dg: dg}
+	}
+	select {
+	case l.conns <- tc:
+	case <-l.done:
+		tc.Close()
+	}
+}
+
+// SetUsers keys new pfs handshakes with the key of the user the client
+// names, or with the transport key if users is empty.
+func (l *Listener) SetUsers(users []conf.User) {
+	if len(users) == 0 {
+		l.users.Store(nil)
+		return
+	}
+	if !l.cfg.PFS {
+		flog.Warnf("kcp: pfs is off, so users share the transport key until the server restarts with pfs")
+	}
+	m := make(map[string][]byte, len(users))
+	for _, u := range users {
+		m[u.Name] = u.Secret
+	}
+	l.users.Store(&m)
+}
+
+func (l *Listener) psk(user string) ([]byte, bool) {
+	users := l.users.Load()
+	if users == nil {
+		return l.cfg.PFSKey, user == ""
+	}
+	key, ok := (*users)[user]
+	return key, ok
+}
+
+func (l *Listener) Accept() (tnet.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("kcp: failed to accept connection: %w", net.ErrClosed)
+	}
+}
+
+// acquire and release count the sessions a client address carries; the
+// emulated TCP connection is only torn down with the last one.
+func (l *Listener) acquire(addr net.Addr) {
+	l.mu.Lock()
+	l.peers[addr.String()]++
+	l.mu.Unlock()
+}
+
+func (l *Listener) release(addr net.Addr) {
+	l.mu.Lock()
+	l.peers[addr.String()]--
+	last := l.peers[addr.String()] <= 0
+	if last {
+		delete(l.peers, addr.String())
+	}
+	l.mu.Unlock()
+	if last {
+		l.PacketConn.CloseFlow(addr)
 	}
-	return &Conn{nil, conn, sess}, nil
 }
 
 func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
 	var err error
 	if l.listener != nil {
 		if e := l.listener.Close(); e != nil {
@@ -68,9 +200,111 @@ func (l *Listener) Addr() net.Addr {
 }
 
 func (l *Listener) SetClientTCPF(addr net.Addr, f []conf.TCPF) {
-	l.PacketConn.SetClientTCPF(addr, f)
+	l.PacketConn.SetClientTCPF(peerAddr(addr), f)
 }
 
+// DeleteClientTCPF keeps the flags while other sessions from the same client
+// address are still open.
 func (l *Listener) DeleteClientTCPF(addr net.Addr) {
-	l.PacketConn.DeleteClientTCPF(addr)
+	addr = peerAddr(addr)
+	l.mu.Lock()
+	shared := l.peers[addr.String()] > 1
+	l.mu.Unlock()
+	if !shared {
+		l.PacketConn.DeleteClientTCPF(addr)
+	}
+}
+
+// convAddr names one KCP conversation with a client, so that kcp-go keeps a
+// session per conversation rather than per address.
+type convAddr struct {
+	*net.UDPAddr
+	conv uint32
+}
+
+func (a *convAddr) String() string {
+	return fmt.Sprintf("%s#%d", a.UDPAddr, a.conv)
+}
+
+func peerAddr(addr net.Addr) net.Addr {
+	if a, ok := addr.(*convAddr); ok {
+		return a.UDPAddr
+	}
+	return addr
+}
+
+// convConn hands kcp-go's listener decrypted packets whose senders are
+// named per conversation.
+type convConn struct {
+	socket.Carrier
+	crypt  *crypter
+	router *router
+	dgrams *dgTable
+}
+
+func (c *convConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.Carrier.ReadFrom(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		a, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		p, ok := c.crypt.open(b[:n])
+		if !ok {
+			continue
+		}
+		conv, ok := c.router.conv(hash.IPAddr(a.IP, uint16(a.Port)), p)
+		if !ok {
+			continue
+		}
+		ca := &convAddr{UDPAddr: a, conv: conv}
+		if isOOB(p) {
+			c.dgrams.deliver(ca.String(), p)
+			continue
+		}
+		return copy(b, p), ca, nil
+	}
+}
+
+func (c *convConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*convAddr)
+	if !ok {
+		return 0, net.InvalidAddrError("invalid address")
+	}
+	return c.crypt.writeTo(c.Carrier, b, a.UDPAddr)
+}
+
+// dgTable holds the datagram channels of a listener's sessions, keyed by
+// their convAddr.
+type dgTable struct {
+	mu sync.RWMutex
+	m  map[string]*datagrams
+}
+
+func (t *dgTable) add(key string, dg *datagrams) {
+	t.mu.Lock()
+	t.m[key] = dg
+	t.mu.Unlock()
+}
+
+func (t *dgTable) remove(key string) {
+	t.mu.Lock()
+	dg := t.m[key]
+	delete(t.m, key)
+	t.mu.Unlock()
+	if dg != nil {
+		dg.close()
+	}
+}
+
+func (t *dgTable) deliver(key string, p []byte) {
+	t.mu.RLock()
+	dg := t.m[key]
+	t.mu.RUnlock()
+	if dg != nil {
+		dg.deliver(p)
+	}
 }
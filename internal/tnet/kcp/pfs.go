@@ -0,0 +1,244 @@
+package kcp
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// With transport.kcp.pfs, each session starts with an X25519 exchange whose
+// public keys are authenticated with the pre-shared key, and its stream is
+// then sealed with keys derived from the exchange. The static block still
+// covers KCP headers, but recorded traffic stays sealed if the key leaks.
+//
+// When the server has users, the pre-shared key is the key of the user the
+// client names in its hello, so a session only comes up between a client
+// and a server that both hold that user's key, and its traffic keys are
+// derived from it.
+const (
+	handshakeTimeout = 10 * time.Second
+	helloSize        = 32 + sha256.Size
+	maxUserName      = 64
+	maxRecord        = 16 * 1024
+	// Both ends ratchet their keys after this many records, so a long
+	// session never uses one key for long.
+	rekeyRecords = 1 << 16
+)
+
+var errHandshake = errors.New("kcp: pfs handshake failed")
+
+func helloMAC(psk []byte, label string, pubs ...[]byte) []byte {
+	m := hmac.New(sha256.New, psk)
+	m.Write([]byte(label))
+	for _, p := range pubs {
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+// clientHandshake runs the client side of the exchange on c as user, which
+// is empty unless psk is that user's key, and returns the sealed connection.
+func clientHandshake(c net.Conn, user string, psk []byte) (net.Conn, error) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cpub := priv.PublicKey().Bytes()
+	hello := slices.Concat(cpub, helloMAC(psk, "paqet-pfs client", cpub, []byte(user)), []byte{byte(len(user))}, []byte(user))
+	if _, err := c.Write(hello); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, helloSize)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return nil, err
+	}
+	spub := reply[:32]
+	if !hmac.Equal(reply[32:], helloMAC(psk, "paqet-pfs server", cpub, spub)) {
+		return nil, errHandshake
+	}
+	return newSecureConn(c, priv, spub, psk, cpub, spub, true)
+}
+
+// serverHandshake runs the server side of the exchange on c, taking the
+// pre-shared key for the user the client names from psk. A peer that
+// cannot authenticate its key gets no reply.
+func serverHandshake(c net.Conn, psk func(user string) ([]byte, bool)) (net.Conn, error) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	hello := make([]byte, helloSize+1+maxUserName)
+	if _, err := io.ReadFull(c, hello[:helloSize+1]); err != nil {
+		return nil, err
+	}
+	n := int(hello[helloSize])
+	if n > maxUserName {
+		return nil, errHandshake
+	}
+	if _, err := io.ReadFull(c, hello[helloSize+1:helloSize+1+n]); err != nil {
+		return nil, err
+	}
+	cpub, user := hello[:32], string(hello[helloSize+1:helloSize+1+n])
+	key, ok := psk(user)
+	if !ok || !hmac.Equal(hello[32:helloSize], helloMAC(key, "paqet-pfs client", cpub, []byte(user))) {
+		return nil, errHandshake
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	spub := priv.PublicKey().Bytes()
+	if _, err := c.Write(slices.Concat(spub, helloMAC(key, "paqet-pfs server", cpub, spub))); err != nil {
+		return nil, err
+	}
+	return newSecureConn(c, priv, cpub, key, cpub, spub, false)
+}
+
+func newSecureConn(c net.Conn, priv *ecdh.PrivateKey, peer, psk, cpub, spub []byte, client bool) (*secureConn, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, errHandshake
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, errHandshake
+	}
+	info := slices.Concat([]byte("paqet-pfs keys"), cpub, spub)
+	keys, err := hkdf.Key(sha256.New, shared, psk, string(info), 2*chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	send, recv := keys[:32], keys[32:]
+	if !client {
+		send, recv = recv, send
+	}
+	sc := &secureConn{Conn: c}
+	if err := sc.send.init(send); err != nil {
+		return nil, err
+	}
+	if err := sc.recv.init(recv); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// direction is the key and record counter of one side of a secureConn.
+type direction struct {
+	key   []byte
+	aead  cipher.AEAD
+	count uint64
+	nonce [chacha20poly1305.NonceSize]byte
+}
+
+func (d *direction) init(key []byte) error {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+	d.key, d.aead, d.count = key, aead, 0
+	return nil
+}
+
+// next returns the nonce for the next record, moving to a fresh key once
+// the current one has sealed rekeyRecords records.
+func (d *direction) next() ([]byte, error) {
+	if d.count == rekeyRecords {
+		key, err := hkdf.Key(sha256.New, d.key, nil, "paqet-pfs rekey", chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.init(key); err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint64(d.nonce[4:], d.count)
+	d.count++
+	return d.nonce[:], nil
+}
+
+// secureConn seals a session's byte stream as length-prefixed records.
+type secureConn struct {
+	net.Conn
+	wmu  sync.Mutex
+	send direction
+	wbuf []byte
+
+	rmu  sync.Mutex
+	recv direction
+	rbuf []byte
+	rem  []byte
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxRecord)]
+		nonce, err := c.send.next()
+		if err != nil {
+			return n, err
+		}
+		size := len(chunk) + c.send.aead.Overhead()
+		c.wbuf = binary.BigEndian.AppendUint16(c.wbuf[:0], uint16(size))
+		c.wbuf = c.send.aead.Seal(c.wbuf, nonce, chunk, c.wbuf[:2])
+		if _, err := c.Conn.Write(c.wbuf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rem) == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(hdr[:]))
+		if size < c.recv.aead.Overhead() || size > maxRecord+c.recv.aead.Overhead() {
+			return 0, fmt.Errorf("kcp: bad record size %d", size)
+		}
+		if cap(c.rbuf) < size {
+			c.rbuf = make([]byte, size)
+		}
+		rec := c.rbuf[:size]
+		if _, err := io.ReadFull(c.Conn, rec); err != nil {
+			return 0, err
+		}
+		nonce, err := c.recv.next()
+		if err != nil {
+			return 0, err
+		}
+		plain, err := c.recv.aead.Open(rec[:0], nonce, rec, hdr[:])
+		if err != nil {
+			return 0, fmt.Errorf("kcp: record authentication failed")
+		}
+		c.rem = plain
+	}
+	n := copy(p, c.rem)
+	c.rem = c.rem[n:]
+	return n, nil
+}
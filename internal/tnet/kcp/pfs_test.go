@@ -0,0 +1,163 @@
+package kcp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// counted counts the bytes written through it.
+type counted struct {
+	net.Conn
+	n atomic.Int64
+}
+
+func (c *counted) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return c.Conn.Write(p)
+}
+
+// handshake runs both sides of the exchange over a pipe, the client as user
+// and the server knowing the keys in users. The server side's writes are
+// counted in sw.
+func handshake(t *testing.T, user string, clientKey []byte, users map[string][]byte) (cc, sc net.Conn, sw *counted, cerr, serr error) {
+	t.Helper()
+	c, s := net.Pipe()
+	t.Cleanup(func() { c.Close(); s.Close() })
+	sw = &counted{Conn: s}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sc, serr = serverHandshake(sw, func(user string) ([]byte, bool) {
+			key, ok := users[user]
+			return key, ok
+		})
+		if serr != nil {
+			s.Close()
+		}
+	}()
+	cc, cerr = clientHandshake(c, user, clientKey)
+	<-done
+	return cc, sc, sw, cerr, serr
+}
+
+func TestHandshakeRekey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cc, sc, _, cerr, serr := handshake(t, "", key, map[string][]byte{"": key})
+	if cerr != nil || serr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", cerr, serr)
+	}
+
+	// Each Write under maxRecord is one record, so this crosses the
+	// rekey point in both directions.
+	const records = rekeyRecords + 100
+	first := bytes.Clone(cc.(*secureConn).send.key)
+	errc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 8)
+		for i := range records {
+			if _, err := io.ReadFull(sc, buf[:1]); err != nil {
+				errc <- err
+				return
+			}
+			if buf[0] != byte(i) {
+				errc <- errors.New("records out of order")
+				return
+			}
+			if _, err := sc.Write(buf[:1]); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	buf := make([]byte, 1)
+	for i := range records {
+		if _, err := cc.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(cc, buf); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, cc.(*secureConn).send.key) {
+		t.Fatal("key was not rotated")
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	users := map[string][]byte{"": []byte("server key"), "alice": []byte("alice key")}
+	tests := []struct {
+		name string
+		user string
+		key  []byte
+	}{
+		{"wrong key", "", []byte("client key")},
+		{"wrong user key", "alice", []byte("server key")},
+		{"unknown user", "bob", []byte("alice key")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, sw, cerr, serr := handshake(t, tt.user, tt.key, users)
+			if !errors.Is(serr, errHandshake) {
+				t.Fatalf("server accepted the client: %v", serr)
+			}
+			if cerr == nil {
+				t.Fatal("client finished the handshake")
+			}
+			if n := sw.n.Load(); n != 0 {
+				t.Fatalf("server replied with %d bytes", n)
+			}
+		})
+	}
+}
+
+func TestHandshakeUser(t *testing.T) {
+	users := map[string][]byte{"": []byte("server key"), "alice": []byte("alice key")}
+	cc, sc, _, cerr, serr := handshake(t, "alice", users["alice"], users)
+	if cerr != nil || serr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", cerr, serr)
+	}
+	go cc.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+// recorder keeps what is written to it instead of sending it.
+type recorder struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recorder) Write(p []byte) (int, error) { return r.buf.Write(p) }
+
+func TestTamperedRecord(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cc, sc, _, cerr, serr := handshake(t, "", key, map[string][]byte{"": key})
+	if cerr != nil || serr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", cerr, serr)
+	}
+	c := cc.(*secureConn)
+	raw := c.Conn
+	rec := &recorder{}
+	c.Conn = rec
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := rec.buf.Bytes()
+	b[len(b)-1] ^= 0x01
+
+	go raw.Write(b)
+	if _, err := sc.Read(make([]byte, 16)); err == nil {
+		t.Fatal("tampered record accepted")
+	}
+}
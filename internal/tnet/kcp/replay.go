@@ -0,0 +1,88 @@
+package kcp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	replayWindow = 2048
+	// replaySenders bounds the windows kept; the least recently heard
+	// sender is forgotten first.
+	replaySenders = 4096
+)
+
+// window is a sliding bitmap over the last replayWindow counters seen from
+// one sender.
+type window struct {
+	top  uint64
+	bits [replayWindow / 64]uint64
+	seen time.Time
+}
+
+func (w *window) accept(ctr uint64) bool {
+	switch {
+	case ctr > w.top:
+		shift := ctr - w.top
+		if shift >= replayWindow {
+			clear(w.bits[:])
+		} else {
+			for i := w.top + 1; i <= ctr; i++ {
+				w.bits[(i/64)%uint64(len(w.bits))] &^= 1 << (i % 64)
+			}
+		}
+		w.top = ctr
+	case w.top-ctr >= replayWindow:
+		return false
+	}
+	word, bit := &w.bits[(ctr/64)%uint64(len(w.bits))], uint64(1)<<(ctr%64)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
+
+// replayFilter remembers which counter nonces each sender, named by its
+// nonce prefix, has used. Counters start at 1, and a packet is accepted at
+// most once and only while it is within the window of the newest one.
+//
+// The windows live in memory only: once a sender's window is evicted, or
+// the process restarts, the sender's earlier packets pass again.
+type replayFilter struct {
+	mu      sync.Mutex
+	senders map[string]*window
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{senders: make(map[string]*window)}
+}
+
+func (f *replayFilter) accept(prefix []byte, ctr uint64) bool {
+	if ctr == 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := f.senders[string(prefix)]
+	if w == nil {
+		if len(f.senders) >= replaySenders {
+			f.evict()
+		}
+		w = &window{}
+		f.senders[string(prefix)] = w
+	}
+	w.seen = time.Now()
+	return w.accept(ctr)
+}
+
+func (f *replayFilter) evict() {
+	var oldest string
+	var t time.Time
+	for k, w := range f.senders {
+		if t.IsZero() || w.seen.Before(t) {
+			oldest, t = k, w.seen
+		}
+	}
+	delete(f.senders, oldest)
+}
@@ -0,0 +1,77 @@
+package kcp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+func TestReplayFilter(t *testing.T) {
+	type step struct {
+		ctr  uint64
+		want bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"zero", []step{{0, false}, {1, true}, {0, false}}},
+		{"duplicate", []step{{1, true}, {1, false}, {2, true}, {1, false}, {2, false}}},
+		{"reordered", []step{{5, true}, {3, true}, {4, true}, {1, true}, {2, true}, {3, false}}},
+		{"too old", []step{{replayWindow + 10, true}, {11, true}, {10, false}, {1, false}}},
+		// 5 and 5+replayWindow share a bit; the jump must clear it.
+		{"jump clears", []step{{5, true}, {5 + replayWindow, true}, {5 + replayWindow, false}, {5, false}}},
+		{"far jump", []step{{5, true}, {5 + 3*replayWindow, true}, {6 + replayWindow, false}, {6 + 2*replayWindow, true}}},
+		// 2112 lands in the same word as 100 after the index wraps. The
+		// slide clears the bits up to 2147 but not 100's.
+		{"wraparound", []step{
+			{100, true}, {2147, true}, {100, false}, {99, false},
+			{2112, true}, {2112, false}, {101, true}, {2148, true}, {100, false}, {101, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newReplayFilter()
+			for i, s := range tt.steps {
+				if got := f.accept([]byte("sender"), s.ctr); got != s.want {
+					t.Fatalf("step %d: accept(%d) = %v, want %v", i, s.ctr, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayFilterSenders(t *testing.T) {
+	f := newReplayFilter()
+	if !f.accept([]byte("a"), 1) || !f.accept([]byte("b"), 1) {
+		t.Fatal("senders share a window")
+	}
+	if f.accept([]byte("a"), 1) {
+		t.Fatal("replay accepted")
+	}
+}
+
+func TestCrypterReplay(t *testing.T) {
+	block, err := kcp.NewAESGCMCrypt(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, rx := newCrypter(block, true), newCrypter(block, true)
+
+	first := tx.seal(make([]byte, 0, mtuLimit), []byte("first"))
+	second := tx.seal(make([]byte, 0, mtuLimit), []byte("second"))
+	replayed := bytes.Clone(first)
+
+	for _, b := range [][]byte{second, first} {
+		if _, ok := rx.open(b); !ok {
+			t.Fatal("fresh packet dropped")
+		}
+	}
+	if _, ok := rx.open(replayed); ok {
+		t.Fatal("replayed packet accepted")
+	}
+	if n := rx.replays.Load(); n != 1 {
+		t.Fatalf("replays = %d, want 1", n)
+	}
+}
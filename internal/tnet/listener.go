@@ -6,6 +6,13 @@ import (
 	"paqet/internal/conf"
 )
 
+// UserListener is a Listener that keys sessions by user; the server tells it
+// of the users it accepts whenever they change.
+type UserListener interface {
+	Listener
+	SetUsers(users []conf.User)
+}
+
 type Listener interface {
 	Accept() (Conn, error)
 	Close() error
@@ -0,0 +1,84 @@
+package mux
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xtaci/smux"
+
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// Conn is an smux session over a reliable connection. Release, if set, is
+// called once the session and connection are closed.
+type Conn struct {
+	Conn    net.Conn
+	Session *smux.Session
+	Release func()
+}
+
+// Config returns the smux settings shared by both sides of a session.
+func Config(smuxbuf, streambuf int, kalive, ktimeout time.Duration) *smux.Config {
+	var sconf = smux.DefaultConfig()
+	sconf.Version = 2
+	sconf.KeepAliveInterval = kalive
+	sconf.KeepAliveTimeout = ktimeout
+	sconf.MaxFrameSize = 65535
+	sconf.MaxReceiveBuffer = smuxbuf
+	sconf.MaxStreamBuffer = streambuf
+	return sconf
+}
+
+func (c *Conn) OpenStrm() (tnet.Strm, error) {
+	strm, err := c.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{strm}, nil
+}
+
+func (c *Conn) AcceptStrm() (tnet.Strm, error) {
+	strm, err := c.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{strm}, nil
+}
+
+func (c *Conn) Ping(wait bool) error {
+	strm, err := c.Session.OpenStream()
+	if err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+	defer strm.Close()
+	if wait {
+		return protocol.Ping(strm)
+	}
+	return nil
+}
+
+func (c *Conn) Close() error {
+	var err error
+	if c.Session != nil {
+		if e := c.Session.Close(); e != nil {
+			err = e
+		}
+	}
+	if c.Conn != nil {
+		if e := c.Conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if c.Release != nil {
+		c.Release()
+	}
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.Session.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.Session.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.Conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.Conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.Conn.SetWriteDeadline(t) }
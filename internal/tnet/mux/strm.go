@@ -1,4 +1,4 @@
-package kcp
+package mux
 
 import (
 	"github.com/xtaci/smux"
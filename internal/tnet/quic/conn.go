@@ -0,0 +1,90 @@
+package quic
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// Conn maps tnet streams onto the streams of a QUIC connection, and carries
+// datagrams as QUIC DATAGRAM frames.
+type Conn struct {
+	conn    *quic.Conn
+	release func()
+}
+
+func (c *Conn) OpenStrm() (tnet.Strm, error) {
+	strm, err := c.conn.OpenStreamSync(c.conn.Context())
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{Stream: strm, conn: c.conn}, nil
+}
+
+func (c *Conn) AcceptStrm() (tnet.Strm, error) {
+	strm, err := c.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{Stream: strm, conn: c.conn}, nil
+}
+
+func (c *Conn) Ping(wait bool) error {
+	strm, err := c.OpenStrm()
+	if err != nil {
+		return err
+	}
+	defer strm.Close()
+	if wait {
+		return protocol.Ping(strm)
+	}
+	return nil
+}
+
+func (c *Conn) SendDatagram(b []byte) error {
+	return c.conn.SendDatagram(b)
+}
+
+func (c *Conn) ReceiveDatagram() ([]byte, error) {
+	return c.conn.ReceiveDatagram(context.Background())
+}
+
+func (c *Conn) Close() error {
+	err := c.conn.CloseWithError(0, "")
+	if c.release != nil {
+		c.release()
+	}
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// QUIC has no connection deadlines; idle_timeout bounds a dead connection.
+func (c *Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+type Strm struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *Strm) SID() int {
+	return int(s.StreamID())
+}
+
+// Close closes both directions, as closing a net.Conn does; closing a QUIC
+// stream only ends the sending side.
+func (s *Strm) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func (s *Strm) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Strm) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
@@ -0,0 +1,52 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+	"paqet/internal/tnet"
+)
+
+// Dialer opens QUIC connections to one server over a single PacketConn.
+type Dialer struct {
+	addr       *net.UDPAddr
+	cfg        *conf.QUIC
+	packetConn socket.Carrier
+	tr         *quic.Transport
+}
+
+func NewDialer(addr *net.UDPAddr, cfg *conf.Transport, netCfg conf.Network) (*Dialer, error) {
+	nCfg := netCfg
+	packetConn, err := socket.NewCarrier(cfg, &nCfg)
+	if err != nil {
+		return nil, fmt.Errorf("quic: failed to create packetconn: %w", err)
+	}
+	return &Dialer{addr: addr, cfg: cfg.QUIC, packetConn: packetConn, tr: &quic.Transport{Conn: packetConn}}, nil
+}
+
+func (d *Dialer) Dial() (tnet.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	conn, err := d.tr.Dial(ctx, d.addr, clientTLS(), quicConf(d.cfg))
+	if err != nil {
+		return nil, fmt.Errorf("quic: failed to dial connection: %w", err)
+	}
+	if err := authenticate(ctx, conn, d.cfg.Secret); err != nil {
+		conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("quic: handshake with %s failed: %w", d.addr, err)
+	}
+	return &Conn{conn: conn}, nil
+}
+
+// Close ends every connection dialed through d, then the emulated TCP
+// connection and the PacketConn.
+func (d *Dialer) Close() error {
+	d.tr.Close()
+	d.packetConn.CloseFlow(d.addr)
+	return d.packetConn.Close()
+}
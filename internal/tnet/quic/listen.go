@@ -0,0 +1,150 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/cert"
+	"paqet/internal/socket"
+	"paqet/internal/tnet"
+)
+
+// Listener accepts QUIC connections on a PacketConn. Clients are verified
+// off the accept loop, so a slow one does not hold up the others.
+type Listener struct {
+	PacketConn socket.Carrier
+	cfg        *conf.QUIC
+	tr         *quic.Transport
+	listener   *quic.Listener
+	conns      chan *Conn
+	done       chan struct{}
+	once       sync.Once
+	mu         sync.Mutex
+	peers      map[string]int
+}
+
+func Listen(cfg *conf.Transport, netCfg conf.Network) (tnet.Listener, error) {
+	nCfg := netCfg
+	packetConn, err := socket.NewCarrier(cfg, &nCfg)
+	if err != nil {
+		return nil, fmt.Errorf("quic: failed to create packetconn: %w", err)
+	}
+	packetConn.Passive()
+
+	crt, err := cert.SelfSigned()
+	if err != nil {
+		packetConn.Close()
+		return nil, fmt.Errorf("quic: failed to create certificate: %w", err)
+	}
+	tr := &quic.Transport{Conn: packetConn}
+	ln, err := tr.Listen(serverTLS(crt), quicConf(cfg.QUIC))
+	if err != nil {
+		packetConn.Close()
+		return nil, fmt.Errorf("quic: failed to listen: %w", err)
+	}
+
+	l := &Listener{
+		PacketConn: packetConn,
+		cfg:        cfg.QUIC,
+		tr:         tr,
+		listener:   ln,
+		conns:      make(chan *Conn),
+		done:       make(chan struct{}),
+		peers:      make(map[string]int),
+	}
+	go l.accept()
+	return l, nil
+}
+
+func (l *Listener) accept() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			l.once.Do(func() { close(l.done) })
+			return
+		}
+		go l.serve(conn)
+	}
+}
+
+// serve verifies a new connection and hands it to Accept.
+func (l *Listener) serve(conn *quic.Conn) {
+	ctx, cancel := context.WithTimeout(conn.Context(), handshakeTimeout)
+	err := verify(ctx, conn, l.cfg.Secret)
+	cancel()
+	if err != nil {
+		flog.Debugf("quic: handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(0, "")
+		return
+	}
+	raddr := conn.RemoteAddr()
+	l.acquire(raddr)
+	c := &Conn{conn: conn, release: func() { l.release(raddr) }}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *Listener) Accept() (tnet.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, fmt.Errorf("quic: failed to accept connection: %w", net.ErrClosed)
+	}
+}
+
+// acquire and release count the connections a client address carries; the
+// emulated TCP connection is only torn down with the last one.
+func (l *Listener) acquire(addr net.Addr) {
+	l.mu.Lock()
+	l.peers[addr.String()]++
+	l.mu.Unlock()
+}
+
+func (l *Listener) release(addr net.Addr) {
+	l.mu.Lock()
+	l.peers[addr.String()]--
+	last := l.peers[addr.String()] <= 0
+	if last {
+		delete(l.peers, addr.String())
+	}
+	l.mu.Unlock()
+	if last {
+		l.PacketConn.CloseFlow(addr)
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	l.listener.Close()
+	l.tr.Close()
+	return l.PacketConn.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *Listener) SetClientTCPF(addr net.Addr, f []conf.TCPF) {
+	l.PacketConn.SetClientTCPF(addr, f)
+}
+
+// DeleteClientTCPF keeps the flags while other connections from the same
+// client address are still open.
+func (l *Listener) DeleteClientTCPF(addr net.Addr) {
+	l.mu.Lock()
+	shared := l.peers[addr.String()] > 1
+	l.mu.Unlock()
+	if !shared {
+		l.PacketConn.DeleteClientTCPF(addr)
+	}
+}
@@ -0,0 +1,134 @@
+package stream
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+	"golang.org/x/net/websocket"
+
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+	"paqet/internal/tnet/mux"
+)
+
+// Dialer opens a kernel TCP connection per session.
+type Dialer struct {
+	addr   *net.UDPAddr
+	cfg    *conf.Stream
+	dialer net.Dialer
+	mu     sync.Mutex
+	conns  map[*mux.Conn]struct{}
+	closed bool
+}
+
+func NewDialer(addr *net.UDPAddr, cfg *conf.Stream, netCfg conf.Network) (*Dialer, error) {
+	d := &Dialer{addr: addr, cfg: cfg, conns: make(map[*mux.Conn]struct{})}
+	d.dialer.Timeout = handshakeTimeout
+	if netCfg.Bind != nil {
+		d.dialer.LocalAddr = &net.TCPAddr{IP: netCfg.Bind.IP, Zone: netCfg.Bind.Zone}
+	}
+	return d, nil
+}
+
+func (d *Dialer) Dial() (tnet.Conn, error) {
+	c, err := d.dialer.Dial("tcp", d.addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("stream: failed to dial %s: %w", d.addr, err)
+	}
+	// The deadline covers the TLS and WebSocket handshakes; respond sets its
+	// own and clears it.
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	c, cs, err := d.wrap(c)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("stream: failed to connect to %s: %w", d.addr, err)
+	}
+	if err := respond(c, d.cfg.Secret, cs); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("stream: handshake with %s failed: %w", d.addr, err)
+	}
+
+	sess, err := smux.Client(c, smuxConf(d.cfg))
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("stream: failed to create smux session: %w", err)
+	}
+	conn := &mux.Conn{Conn: c, Session: sess}
+	conn.Release = func() { d.release(conn) }
+
+	d.mu.Lock()
+	closed := d.closed
+	if !closed {
+		d.conns[conn] = struct{}{}
+	}
+	d.mu.Unlock()
+	if closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+// wrap layers TLS and WebSocket over c as the mode asks.
+func (d *Dialer) wrap(c net.Conn) (net.Conn, *tls.ConnectionState, error) {
+	var cs *tls.ConnectionState
+	host := d.addr.IP.String()
+	if d.cfg.ServerName != "" {
+		host = d.cfg.ServerName
+	}
+	if usesTLS(d.cfg) {
+		tc := tls.Client(c, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: d.cfg.Insecure,
+			MinVersion:         tls.VersionTLS13,
+			NextProtos:         []string{"http/1.1"},
+		})
+		if err := tc.Handshake(); err != nil {
+			return c, nil, err
+		}
+		state := tc.ConnectionState()
+		c, cs = tc, &state
+	}
+	if d.cfg.Mode == "ws" || d.cfg.Mode == "wss" {
+		scheme := "ws"
+		if usesTLS(d.cfg) {
+			scheme = "wss"
+		}
+		host = net.JoinHostPort(host, fmt.Sprint(d.addr.Port))
+		wcfg, err := websocket.NewConfig(scheme+"://"+host+d.cfg.Path, "http://"+host)
+		if err != nil {
+			return c, nil, err
+		}
+		ws, err := websocket.NewClient(wcfg, c)
+		if err != nil {
+			return c, nil, err
+		}
+		return newWSConn(ws, c.LocalAddr(), c.RemoteAddr()), cs, nil
+	}
+	return c, cs, nil
+}
+
+func (d *Dialer) release(conn *mux.Conn) {
+	d.mu.Lock()
+	delete(d.conns, conn)
+	d.mu.Unlock()
+}
+
+// Close closes every connection dialed through d.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	conns := make([]*mux.Conn, 0, len(d.conns))
+	for conn := range d.conns {
+		conns = append(conns, conn)
+	}
+	d.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package stream
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+	"golang.org/x/net/websocket"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/cert"
+	"paqet/internal/tnet"
+	"paqet/internal/tnet/mux"
+)
+
+// Listener accepts sessions over kernel TCP connections. Handshakes run
+// off the accept loop, so a slow client does not hold up the others.
+type Listener struct {
+	cfg   *conf.Stream
+	ln    net.Listener
+	http  *http.Server
+	conns chan *mux.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func Listen(cfg *conf.Stream, netCfg conf.Network) (tnet.Listener, error) {
+	ln, err := net.Listen("tcp", netCfg.Bind.String())
+	if err != nil {
+		return nil, fmt.Errorf("stream: failed to listen on %s: %w", netCfg.Bind, err)
+	}
+	if usesTLS(cfg) {
+		crt := cfg.Certificate
+		if crt == nil {
+			c, err := cert.SelfSigned()
+			if err != nil {
+				ln.Close()
+				return nil, fmt.Errorf("stream: failed to create certificate: %w", err)
+			}
+			crt = &c
+		}
+		ln = tls.NewListener(ln, &tls.Config{
+			Certificates: []tls.Certificate{*crt},
+			MinVersion:   tls.VersionTLS13,
+			NextProtos:   []string{"http/1.1"},
+		})
+	}
+
+	l := &Listener{cfg: cfg, ln: ln, conns: make(chan *mux.Conn), done: make(chan struct{})}
+	if cfg.Mode == "ws" || cfg.Mode == "wss" {
+		m := http.NewServeMux()
+		m.Handle(cfg.Path, websocket.Server{Handler: l.serveWS})
+		l.http = &http.Server{Handler: m, ReadHeaderTimeout: handshakeTimeout}
+		go l.http.Serve(ln)
+	} else {
+		go l.accept()
+	}
+	return l, nil
+}
+
+func (l *Listener) accept() {
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			flog.Debugf("stream: accept failed: %v", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go func() {
+			var cs *tls.ConnectionState
+			if tc, ok := c.(*tls.Conn); ok {
+				tc.SetDeadline(time.Now().Add(handshakeTimeout))
+				if err := tc.Handshake(); err != nil {
+					flog.Debugf("stream: TLS handshake with %s failed: %v", c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+				state := tc.ConnectionState()
+				cs = &state
+			}
+			l.serve(c, cs)
+		}()
+	}
+}
+
+// serveWS runs a session for the length of its WebSocket handler, which
+// closes the connection on return.
+func (l *Listener) serveWS(ws *websocket.Conn) {
+	req := ws.Request()
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote, _ := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if conn := l.serve(newWSConn(ws, local, remote), req.TLS); conn != nil {
+		<-conn.Session.CloseChan()
+	}
+}
+
+// serve authenticates c and hands its session to Accept.
+func (l *Listener) serve(c net.Conn, cs *tls.ConnectionState) *mux.Conn {
+	if err := challenge(c, l.cfg.Secret, cs); err != nil {
+		flog.Debugf("stream: handshake with %s failed: %v", c.RemoteAddr(), err)
+		c.Close()
+		return nil
+	}
+	sess, err := smux.Server(c, smuxConf(l.cfg))
+	if err != nil {
+		c.Close()
+		return nil
+	}
+	conn := &mux.Conn{Conn: c, Session: sess}
+	select {
+	case l.conns <- conn:
+		return conn
+	case <-l.done:
+		conn.Close()
+		return nil
+	}
+}
+
+func (l *Listener) Accept() (tnet.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("stream: failed to accept connection: %w", net.ErrClosed)
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	if l.http != nil {
+		return l.http.Close()
+	}
+	return l.ln.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *Listener) SetClientTCPF(addr net.Addr, f []conf.TCPF) {}
+func (l *Listener) DeleteClientTCPF(addr net.Addr)             {}
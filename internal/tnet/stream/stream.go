@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/xtaci/smux"
+
+	"paqet/internal/conf"
+	"paqet/internal/tnet/mux"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	challengeSize    = 32
+	exporterLabel    = "EXPORTER-paqet-stream"
+	clientLabel      = "paqet-stream client"
+	serverLabel      = "paqet-stream server"
+)
+
+func smuxConf(cfg *conf.Stream) *smux.Config {
+	return mux.Config(cfg.Smuxbuf, cfg.Streambuf, cfg.Smuxkalive, cfg.Smuxktimeout)
+}
+
+func usesTLS(cfg *conf.Stream) bool {
+	return cfg.Mode == "tls" || cfg.Mode == "wss"
+}
+
+// proof shows that one side holds the key. It covers both sides'
+// challenges, so neither can be replayed, and is bound to the TLS session
+// when there is one, so a relayed handshake fails even when the client
+// skips certificate verification. The label keeps the client's and the
+// server's proofs apart.
+func proof(secret []byte, label string, sc, cc []byte, cs *tls.ConnectionState) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(label))
+	m.Write(sc)
+	m.Write(cc)
+	if cs != nil {
+		b, err := cs.ExportKeyingMaterial(exporterLabel, nil, 32)
+		if err == nil {
+			m.Write(b)
+		}
+	}
+	return m.Sum(nil)
+}
+
+// challenge authenticates the client on a new server connection, then
+// proves the server's own knowledge of the key to it.
+func challenge(c net.Conn, secret []byte, cs *tls.ConnectionState) error {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	sc := make([]byte, challengeSize)
+	rand.Read(sc)
+	if _, err := c.Write(sc); err != nil {
+		return err
+	}
+	b := make([]byte, challengeSize+sha256.Size)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	cc, p := b[:challengeSize], b[challengeSize:]
+	if !hmac.Equal(p, proof(secret, clientLabel, sc, cc, cs)) {
+		return fmt.Errorf("bad key")
+	}
+	_, err := c.Write(proof(secret, serverLabel, sc, cc, cs))
+	return err
+}
+
+// respond answers the server's challenge on a new client connection with a
+// challenge of its own, and checks the server's proof before the
+// connection is used.
+func respond(c net.Conn, secret []byte, cs *tls.ConnectionState) error {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	sc := make([]byte, challengeSize)
+	if _, err := io.ReadFull(c, sc); err != nil {
+		return err
+	}
+	cc := make([]byte, challengeSize)
+	rand.Read(cc)
+	if _, err := c.Write(append(cc, proof(secret, clientLabel, sc, cc, cs)...)); err != nil {
+		return err
+	}
+	// The server closes on a bad proof.
+	p := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(c, p); err != nil {
+		return fmt.Errorf("rejected by server: %w", err)
+	}
+	if !hmac.Equal(p, proof(secret, serverLabel, sc, cc, cs)) {
+		return fmt.Errorf("server does not hold the key")
+	}
+	return nil
+}
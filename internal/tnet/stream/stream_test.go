@@ -0,0 +1,123 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"paqet/internal/conf"
+)
+
+func testConfig(mode, key string) *conf.Stream {
+	return &conf.Stream{
+		Mode: mode, Path: "/", Secret: []byte(key), Insecure: true,
+		Smuxbuf: 4 << 20, Streambuf: 2 << 20, Smuxkalive: 2 * time.Second, Smuxktimeout: 8 * time.Second,
+	}
+}
+
+func loopback() conf.Network {
+	return conf.Network{Bind: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+}
+
+func dialer(t *testing.T, addr net.Addr, cfg *conf.Stream) *Dialer {
+	a := addr.(*net.TCPAddr)
+	d, err := NewDialer(&net.UDPAddr{IP: a.IP, Port: a.Port}, cfg, conf.Network{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestLoopback(t *testing.T) {
+	for _, mode := range []string{"tcp", "tls", "ws", "wss"} {
+		t.Run(mode, func(t *testing.T) {
+			l, err := Listen(testConfig(mode, "k"), loopback())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				strm, err := conn.AcceptStrm()
+				if err != nil {
+					return
+				}
+				io.Copy(strm, strm)
+				strm.Close()
+			}()
+
+			conn, err := dialer(t, l.Addr(), testConfig(mode, "k")).Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			strm, err := conn.OpenStrm()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer strm.Close()
+
+			msg := bytes.Repeat([]byte("paqet"), 10000)
+			go strm.Write(msg)
+			got := make([]byte, len(msg))
+			strm.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(strm, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatal("echoed data does not match")
+			}
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	l, err := Listen(testConfig("tcp", "k"), loopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := dialer(t, l.Addr(), testConfig("tcp", "wrong")).Dial(); err == nil {
+		t.Fatal("dial with the wrong key succeeded")
+	}
+}
+
+// TestFakeServer checks that the client rejects a server that accepts its
+// proof without holding the key.
+func TestFakeServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, challengeSize+32)
+		rand.Read(b[:challengeSize])
+		c.Write(b[:challengeSize])
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		rand.Read(b[:32])
+		c.Write(b[:32])
+		io.Copy(io.Discard, c)
+	}()
+
+	_, err = dialer(t, ln.Addr(), testConfig("tcp", "k")).Dial()
+	if err == nil || !strings.Contains(err.Error(), "does not hold the key") {
+		t.Fatalf("dial to a server without the key: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package stream
+
+import (
+	"net"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn is a binary WebSocket connection that reports the addresses of the
+// TCP connection beneath it rather than WebSocket URLs.
+type wsConn struct {
+	*websocket.Conn
+	local, remote net.Addr
+}
+
+func newWSConn(ws *websocket.Conn, local, remote net.Addr) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, local: local, remote: remote}
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.local }
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,38 @@
+// Package transport picks the tnet implementation for the configured
+// transport protocol.
+package transport
+
+import (
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+	"paqet/internal/tnet/kcp"
+	"paqet/internal/tnet/quic"
+	"paqet/internal/tnet/stream"
+)
+
+func NewDialer(cfg *conf.Conf) (tnet.Dialer, error) {
+	var d tnet.Dialer
+	var err error
+	switch cfg.Transport.Protocol {
+	case "stream":
+		d, err = stream.NewDialer(cfg.Server.Addr, cfg.Transport.Stream, cfg.Network)
+	case "quic":
+		d, err = quic.NewDialer(cfg.Server.Addr, &cfg.Transport, cfg.Network)
+	default:
+		d, err = kcp.NewDialer(cfg.Server.Addr, &cfg.Transport, cfg.Network, cfg.User)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func Listen(cfg *conf.Conf) (tnet.Listener, error) {
+	switch cfg.Transport.Protocol {
+	case "stream":
+		return stream.Listen(cfg.Transport.Stream, cfg.Network)
+	case "quic":
+		return quic.Listen(&cfg.Transport, cfg.Network)
+	}
+	return kcp.Listen(&cfg.Transport, cfg.Network)
+}